@@ -8,7 +8,15 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// Build the router table at init.
+// App is a self-contained router table. It implements http.Handler, so it
+// can be mounted anywhere and created as many times as needed in the same
+// binary. Error handlers are still shared by the whole process in this
+// version, see SetErrorHandler.
+type App struct {
+	router *mux.Router
+}
+
+// Build a new application from a routes map.
 //
 // Example routes map:
 //    map[string]app.Handler{
@@ -17,9 +25,8 @@ import (
 //      ....
 //    }
 //
-func Router(routes map[string]Handler) {
+func NewApp(routes map[string]Handler) *App {
 	r := mux.NewRouter().StrictSlash(true)
-	http.Handle("/", r)
 
 	for route, handler := range routes {
 		parts := strings.Split(route, "::")
@@ -46,4 +53,16 @@ func Router(routes map[string]Handler) {
 			r.Handle(parts[1], Handler(handler)).Methods(parts[0])
 		}
 	}
+
+	return &App{router: r}
+}
+
+func (a *App) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.router.ServeHTTP(w, req)
+}
+
+// Build the router table at init and serve it from the root of
+// http.DefaultServeMux. See NewApp for the routes map format.
+func Router(routes map[string]Handler) {
+	http.Handle("/", NewApp(routes))
 }
@@ -26,6 +26,8 @@ type Request struct {
 	C   appengine.Context
 	N   *goon.Goon
 	Session *sessions.Session
+
+	app *App
 }
 
 // Load the request data using gorilla schema into a struct
@@ -158,7 +160,10 @@ func (r *Request) processError(err error) {
 		r.LogError(err)
 	}
 
-	h, ok := errorHandlers[code]
+	h, ok := r.app.errorHandlers[code]
+	if !ok {
+		h, ok = errorHandlers[code]
+	}
 	if ok {
 		if err := h(r); err == nil {
 			return
@@ -9,7 +9,6 @@ import (
 	"bytes"
 
 	"conf"
-	"server/model"
 
 	"appengine"
 
@@ -22,14 +21,27 @@ import (
 )
 
 var (
-	dStore = gaesessions.NewDatastoreStore(model.KIND_SESSION,
-			[]byte(conf.SESSION_SECRET))
+	// Datastore kind of the sessions saved by the default store of the apps
+	// created with NewApp. Apps upgrading from an older version must set it
+	// to their old model.KIND_SESSION before, or the existing sessions are lost.
+	DefaultSessionKind = "Session"
+
 	xsrfCodecs = securecookie.CodecsFromPairs([]byte(conf.XSRF_SECRET))
 )
 
 type Handler func(r *Request) error
 
-// Build the router table at init().
+// App is a self-contained router table with its own error handlers. It
+// implements http.Handler, so it can be mounted anywhere (under a prefix with
+// http.StripPrefix, in a httptest server, ...) and created as many times as
+// needed in the same binary.
+type App struct {
+	router        *mux.Router
+	errorHandlers map[int]Handler
+	sessionStore  sessions.Store
+}
+
+// Build a new application from a routes map.
 //
 // Example routes map:
 //    map[string]app.Handler{
@@ -39,15 +51,19 @@ type Handler func(r *Request) error
 //      "::/_/feedback": stuff.Feedback,
 //    }
 //
-func Router(routes map[string]Handler) {
-	r := mux.NewRouter().StrictSlash(true)
-	r.NotFoundHandler = appstatsWrapper(func(r *Request) error {
+func NewApp(routes map[string]Handler) *App {
+	a := &App{
+		router:        mux.NewRouter().StrictSlash(true),
+		errorHandlers: map[int]Handler{},
+		sessionStore: gaesessions.NewDatastoreStore(DefaultSessionKind,
+			[]byte(conf.SESSION_SECRET)),
+	}
+	a.router.NotFoundHandler = a.wrap(func(r *Request) error {
 		return NotFound()
 	})
-	http.Handle("/", r)
 
 	for route, handler := range routes {
-		h := appstatsWrapper(handler)
+		h := a.wrap(handler)
 		parts := strings.Split(route, "::")
 		if len(parts) != 2 {
 			panic("route not in the method::path format")
@@ -59,19 +75,49 @@ func Router(routes map[string]Handler) {
 			if err != nil {
 				panic(err)
 			}
-			SetErrorHandler(int(n), handler)
+			a.SetErrorHandler(int(n), handler)
 			continue
-		} 
+		}
 
 		// Generalist handlers (no method specified)
 		if len(parts[0]) == 0 {
-			r.Handle(parts[1], h)
+			a.router.Handle(parts[1], h)
 			continue
 		}
 
 		// Handlers for a concrete method
-		r.Handle(parts[1], h).Methods(parts[0])
+		a.router.Handle(parts[1], h).Methods(parts[0])
 	}
+
+	return a
+}
+
+func (a *App) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.router.ServeHTTP(w, req)
+}
+
+// Sets a new handler function for HTTP errors of this app only. It takes
+// precedence over the ones registered with the global SetErrorHandler.
+func (a *App) SetErrorHandler(code int, f Handler) {
+	a.errorHandlers[code] = f
+}
+
+// Changes the store where the sessions are saved (the datastore one by
+// default). Any gorilla sessions store works, like sessions.NewCookieStore.
+func (a *App) SetSessionStore(store sessions.Store) {
+	a.sessionStore = store
+}
+
+// Build the router table at init() and serve it from the root of
+// http.DefaultServeMux. See NewApp for the routes map format.
+//
+// The sessions are saved with the DefaultSessionKind datastore kind. Apps
+// upgrading from an older version must set it to their model.KIND_SESSION
+// first, or the existing sessions are lost:
+//    app.DefaultSessionKind = model.KIND_SESSION
+//    app.Router(routes)
+func Router(routes map[string]Handler) {
+	http.Handle("/", NewApp(routes))
 }
 
 type responseWriter struct {
@@ -100,7 +146,7 @@ func (w *responseWriter) output() error {
 	return err
 }
 
-func appstatsWrapper(h Handler) http.Handler {
+func (a *App) wrap(h Handler) http.Handler {
 	f := func(c appengine.Context, w http.ResponseWriter, req *http.Request) {
 		// Emit some compatibility & anti-cache headers for IE (you can overwrite
 		// them from the handlers)
@@ -111,9 +157,9 @@ func appstatsWrapper(h Handler) http.Handler {
 
 		// Build the request & session objects
 		rw := newResponseWriter(w)
-		r := &Request{Req: req, W: rw, C: c, N: goon.FromContext(c)}
+		r := &Request{Req: req, W: rw, C: c, N: goon.FromContext(c), app: a}
 
-		session, token, err := getSession(req, rw)
+		session, token, err := getSession(a.sessionStore, req, rw)
 		if err != nil {
 			r.processError(fmt.Errorf("build session failed: %s", err))
 			return
@@ -157,8 +203,8 @@ func appstatsWrapper(h Handler) http.Handler {
 }
 
 // Return the session, the old XSRF token and an error if needed
-func getSession(req *http.Request, w http.ResponseWriter) (*sessions.Session, []uint8, error) {
-	session, _ := dStore.Get(req, conf.SESSION_NAME)
+func getSession(store sessions.Store, req *http.Request, w http.ResponseWriter) (*sessions.Session, []uint8, error) {
+	session, _ := store.Get(req, conf.SESSION_NAME)
 	session.Options = &sessions.Options{
 		Path: "/",
 		MaxAge: 7 * 24 * 60 * 60, // 7 days
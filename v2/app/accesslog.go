@@ -0,0 +1,113 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"appengine"
+)
+
+// Header with the ID of the request. It's read from the incoming requests if
+// present (a proxy or another service may set it) and sent back in the
+// response.
+var RequestIDHeader = "X-Request-Id"
+
+// AccessLogEntry describes a served request.
+type AccessLogEntry struct {
+	RequestID string        `json:"requestId"`
+	Method    string        `json:"method"`
+	Route     string        `json:"route,omitempty"`
+	Path      string        `json:"path"`
+	Status    int           `json:"status"`
+	Size      int64         `json:"size"`
+	Latency   time.Duration `json:"-"`
+	User      string        `json:"user,omitempty"`
+}
+
+// AccessLogger records an entry for every request, after the response has
+// been written.
+type AccessLogger func(c appengine.Context, e *AccessLogEntry)
+
+// Logs the entry as a JSON line with the "[access]" prefix.
+func DefaultAccessLogger(c appengine.Context, e *AccessLogEntry) {
+	data, err := json.Marshal(struct {
+		*AccessLogEntry
+		LatencyMs float64 `json:"latencyMs"`
+	}{e, e.Latency.Seconds() * 1000})
+	if err != nil {
+		c.Errorf("marshal access log entry failed: %s", err)
+		return
+	}
+	c.Infof("[access] %s", data)
+}
+
+// Returns the ID of the request, to correlate its logs and error reports.
+func (r *Request) ID() string {
+	return r.id
+}
+
+// Records the authenticated user of the request, included in the access log
+// and the error reports.
+func (r *Request) SetUser(user string) {
+	r.user = user
+}
+
+// Returns the user recorded with SetUser.
+func (r *Request) User() string {
+	return r.user
+}
+
+// Uses the incoming ID if valid, or the App Engine one if not.
+func requestID(c appengine.Context, req *http.Request) string {
+	if id := req.Header.Get(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	if id := appengine.RequestID(c); id != "" {
+		return id
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		c.Errorf("generate request id failed: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Incoming IDs end up in the logs, only short printable ones are accepted.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Request) logAccess(start time.Time) {
+	if r.app.accessLogger == nil {
+		return
+	}
+
+	e := &AccessLogEntry{
+		RequestID: r.id,
+		Method:    r.Req.Method,
+		Path:      r.Req.URL.Path,
+		Status:    r.rw.code,
+		Size:      r.rw.size,
+		Latency:   time.Since(start),
+		User:      r.user,
+	}
+	if r.route != nil {
+		e.Route = r.route.path
+	}
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	r.app.accessLogger(r.C, e)
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Body of the JSON error responses of the API requests.
+type jsonError struct {
+	Code      int               `json:"code"`
+	Message   string            `json:"message"`
+	RequestID string            `json:"requestId"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// Marks the named routes as API ones, their errors are returned as JSON. It
+// panics if a route doesn't exist.
+func (a *App) API(names ...string) {
+	for _, name := range names {
+		for _, entry := range a.routesNamed(name) {
+			entry.api = true
+		}
+	}
+}
+
+// Marks all the routes of the group, including the nested ones, as API ones.
+func (g *Group) API() {
+	g.api = true
+}
+
+// Returns true if the errors of the request should be returned as JSON: the
+// route is an API one or the client accepts JSON but not HTML.
+func (r *Request) IsAPI() bool {
+	if r.route != nil && r.route.isAPI() {
+		return true
+	}
+
+	accept := r.Req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") &&
+		!strings.Contains(accept, "text/html")
+}
+
+// Emits the error as a JSON body with the XSSI prefix, like EmitJson. Only the
+// public message of the error is sent, never its cause.
+func (r *Request) emitJsonError(code int, err error) {
+	body := &jsonError{
+		Code:      code,
+		Message:   http.StatusText(code),
+		RequestID: r.id,
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		body.Message = e.PublicMessage()
+		body.Fields = e.Fields
+	}
+
+	r.W.Header().Set("Content-Type", "application/json; charset=utf-8")
+	r.W.WriteHeader(code)
+	if err := r.EmitJson(map[string]*jsonError{"error": body}); err != nil {
+		r.C.Errorf("[request %s] emit json error failed: %s", r.id, err)
+	}
+}
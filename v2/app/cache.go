@@ -0,0 +1,171 @@
+package app
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CachePolicy describes the Cache-Control header of the responses.
+type CachePolicy struct {
+	// Shared caches (proxies, CDNs) can store the response too
+	Public bool
+
+	// The response is never stored; the rest of fields are ignored
+	NoStore bool
+
+	// The response is stored but revalidated before every use
+	NoCache bool
+
+	// Freshness lifetime for all the caches and for the shared ones
+	MaxAge, SMaxAge time.Duration
+
+	// Time a stale response can be used while it's revalidated in background
+	StaleWhileRevalidate time.Duration
+}
+
+var (
+	// Default policy of the new apps. Change it with App.SetCachePolicy.
+	NoStore = &CachePolicy{NoStore: true}
+
+	// Stored by the browser only and revalidated before every use.
+	Revalidate = &CachePolicy{NoCache: true}
+)
+
+// Returns the value of the Cache-Control header.
+func (p *CachePolicy) String() string {
+	if p.NoStore {
+		return "no-store"
+	}
+
+	directives := []string{"private"}
+	if p.Public {
+		directives[0] = "public"
+	}
+	if p.NoCache {
+		directives = append(directives, "no-cache")
+	}
+	directives = append(directives, fmt.Sprintf("max-age=%d", int(p.MaxAge.Seconds())))
+	if p.SMaxAge > 0 {
+		directives = append(directives, fmt.Sprintf("s-maxage=%d", int(p.SMaxAge.Seconds())))
+	}
+	if p.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d",
+			int(p.StaleWhileRevalidate.Seconds())))
+	}
+	return strings.Join(directives, ", ")
+}
+
+// Applies the cache policy to all the responses of the route, overriding the
+// app default one. Example:
+//    "::/landing": app.With(pages.Landing, app.Cache(&app.CachePolicy{
+//      Public: true,
+//      MaxAge: 5 * time.Minute,
+//    })),
+func Cache(p *CachePolicy) Middleware {
+	return func(h Handler) Handler {
+		return func(r *Request) error {
+			r.SetCachePolicy(p)
+			return h(r)
+		}
+	}
+}
+
+// Overrides the cache policy of the app and the route for this response. A
+// nil policy removes the Cache-Control header. Error responses always use the
+// NoStore policy.
+func (r *Request) SetCachePolicy(p *CachePolicy) {
+	if p == nil {
+		r.W.Header().Del("Cache-Control")
+		return
+	}
+	r.W.Header().Set("Cache-Control", p.String())
+}
+
+// Enables the conditional GET support for the route, see Request.EnableETag.
+func ETags(h Handler) Handler {
+	return func(r *Request) error {
+		r.EnableETag()
+		return h(r)
+	}
+}
+
+// Enables the conditional GET support for this response: a strong ETag is
+// generated from the buffered body (unless the handler sets one) and the
+// If-None-Match & If-Modified-Since headers are answered with a 304. A NoStore
+// cache policy is replaced by the Revalidate one, so the browser can keep the
+// response.
+func (r *Request) EnableETag() {
+	r.rw.etag = true
+	if r.W.Header().Get("Cache-Control") == NoStore.String() {
+		r.SetCachePolicy(Revalidate)
+	}
+}
+
+// Declares the last modification time of the response, to answer the
+// If-Modified-Since headers when the ETags are enabled.
+func (r *Request) SetLastModified(t time.Time) {
+	r.W.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
+
+// Replaces the response with a 304 if the request conditions match the
+// buffered one. It should run after any change to the body and before
+// committing the response.
+func (w *responseWriter) conditional(req *http.Request) {
+	if !w.etag || w.streaming || w.committed {
+		return
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return
+	}
+	if w.code != 0 && w.code != http.StatusOK {
+		return
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		etag = fmt.Sprintf(`"%x"`, sha1.Sum(w.buf.Bytes()))
+		w.Header().Set("ETag", etag)
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			w.notModified()
+		}
+		return
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return
+	}
+	lm, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if err != nil {
+		return
+	}
+	if !lm.Truncate(time.Second).After(ims) {
+		w.notModified()
+	}
+}
+
+func (w *responseWriter) notModified() {
+	w.buf.Reset()
+	w.code = http.StatusNotModified
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+}
+
+// Returns true if the If-None-Match header contains the ETag. It uses the
+// weak comparison, as the RFC requires for this header.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Compression settings for the buffered responses.
+type CompressionConfig struct {
+	// Bodies smaller than this (in bytes) are not worth compressing
+	MinSize int
+
+	// Media types (without parameters) that can be compressed
+	ContentTypes []string
+}
+
+// Settings used by the new apps. Change them with App.SetCompression.
+var DefaultCompression = &CompressionConfig{
+	MinSize: 1024,
+	ContentTypes: []string{
+		"application/javascript",
+		"application/json",
+		"application/xml",
+		"image/svg+xml",
+		"text/css",
+		"text/html",
+		"text/javascript",
+		"text/plain",
+		"text/xml",
+	},
+}
+
+// Sends the response of the route uncompressed, see
+// Request.DisableCompression.
+func NoCompression(h Handler) Handler {
+	return func(r *Request) error {
+		r.DisableCompression()
+		return h(r)
+	}
+}
+
+// Sends the response uncompressed even if the client accepts it.
+func (r *Request) DisableCompression() {
+	r.rw.noCompression = true
+}
+
+// Compresses the buffered body with gzip or deflate if the client accepts
+// it and the response is worth it. It should run before committing the
+// response.
+func (w *responseWriter) compress(req *http.Request, c *CompressionConfig) error {
+	if c == nil || w.noCompression || w.streaming || w.committed {
+		return nil
+	}
+	if w.code == http.StatusNoContent || w.code == http.StatusNotModified {
+		return nil
+	}
+	if w.Header().Get("Content-Encoding") != "" || w.buf.Len() < c.MinSize {
+		return nil
+	}
+
+	// Sniff the content type now, it can't be done with the compressed body
+	ct := w.Header().Get("Content-Type")
+	if ct == "" {
+		ct = http.DetectContentType(w.buf.Bytes())
+		w.Header().Set("Content-Type", ct)
+	}
+	if !compressibleType(ct, c.ContentTypes) {
+		return nil
+	}
+
+	// The response depends on the Accept-Encoding header from here
+	addVary(w.Header(), "Accept-Encoding")
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	var cw io.WriteCloser
+	if encoding == "gzip" {
+		cw = gzip.NewWriter(buf)
+	} else {
+		// HTTP deflate is the zlib format, not the raw one
+		cw = zlib.NewWriter(buf)
+	}
+	if _, err := io.Copy(cw, w.buf); err != nil {
+		return fmt.Errorf("compress response failed: %s", err)
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("close %s writer failed: %s", encoding, err)
+	}
+
+	w.buf = buf
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Del("Content-Length")
+	return nil
+}
+
+func compressibleType(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range allowed {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the preferred encoding of the Accept-Encoding header between gzip
+// and deflate (gzip on ties), or an empty string if none is accepted. The
+// codings not listed get the "*" quality, and q=0 refuses them.
+func negotiateEncoding(header string) string {
+	qs := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "deflate" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.ToLower(strings.TrimSpace(param))
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qs[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		q, ok := qs[coding]
+		if !ok {
+			q, ok = qs["*"]
+		}
+		if !ok || q <= 0 {
+			continue
+		}
+		if best == "" || q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// Adds the value to the Vary header if it's not there already.
+func addVary(header http.Header, value string) {
+	for _, v := range header["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), value) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", value)
+}
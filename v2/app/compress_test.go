@@ -0,0 +1,82 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header, expected string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"br", ""},
+		{"GZip", "gzip"},
+		{"gzip, deflate", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"deflate;q=1, gzip;q=1", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;Q=0.5, deflate", "deflate"},
+		{"gzip; q=0.8, deflate; q=0.9", "deflate"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, deflate", "deflate"},
+		{"identity", ""},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=0, *", "deflate"},
+		{"*;q=0.5, deflate", "deflate"},
+		{"gzip;q=invalid", "gzip"},
+	}
+	for _, test := range tests {
+		if got := negotiateEncoding(test.header); got != test.expected {
+			t.Errorf("%q: got %q, expected %q", test.header, got, test.expected)
+		}
+	}
+}
+
+func TestCompressibleType(t *testing.T) {
+	allowed := []string{"text/html", "application/json"}
+	tests := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"text/html", true},
+		{"text/html; charset=utf-8", true},
+		{"Application/JSON", true},
+		{"image/png", false},
+		{"text/htmlx", false},
+		{"", false},
+		{"not a type", false},
+	}
+	for _, test := range tests {
+		if got := compressibleType(test.contentType, allowed); got != test.expected {
+			t.Errorf("%q: got %v, expected %v", test.contentType, got, test.expected)
+		}
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	tests := []struct {
+		existing []string
+		expected string
+	}{
+		{nil, "Accept-Encoding"},
+		{[]string{"Origin"}, "Origin, Accept-Encoding"},
+		{[]string{"Accept-Encoding"}, "Accept-Encoding"},
+		{[]string{"origin, accept-encoding"}, "origin, accept-encoding"},
+		{[]string{"Origin", "Cookie"}, "Origin, Cookie, Accept-Encoding"},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		for _, v := range test.existing {
+			header.Add("Vary", v)
+		}
+		addVary(header, "Accept-Encoding")
+		if got := strings.Join(header["Vary"], ", "); got != test.expected {
+			t.Errorf("%q: got %q, expected %q", test.existing, got, test.expected)
+		}
+	}
+}
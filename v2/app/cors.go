@@ -0,0 +1,161 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy describes which cross-origin requests are allowed. Set it for
+// the whole app (App.SetCORS) or for a group of routes (Group.SetCORS).
+//
+// Credentialed requests keep passing the XSRF check: the allowed origins
+// can't read the XSRF-TOKEN cookie, so the current token is sent to them in
+// the X-XSRF-TOKEN response header instead.
+type CORSPolicy struct {
+	// Allowed origins: exact ones ("https://m.example.com"), with a wildcard
+	// subdomain ("https://*.example.com", matching a single level as in the
+	// TLS certificates) or "*" for any origin. The "*" origin never gets
+	// credentials.
+	Origins []string
+
+	// Allowed methods, the ones of the matching routes if empty
+	Methods []string
+
+	// Request headers allowed, DefaultCORSHeaders if empty
+	Headers []string
+
+	// Response headers the browser scripts can read
+	ExposedHeaders []string
+
+	// Allows the cookies and the authorization headers
+	Credentials bool
+
+	// Time the preflight response can be cached, zero to omit it
+	MaxAge time.Duration
+}
+
+// Request headers allowed by the policies without their own list.
+var DefaultCORSHeaders = []string{"Content-Type", "Authorization", "X-Xsrf-Token"}
+
+// Returns the value of the Access-Control-Allow-Origin header for the origin,
+// or an empty string if it's not allowed.
+func (p *CORSPolicy) allowOrigin(origin string) string {
+	wildcard := false
+	for _, pattern := range p.Origins {
+		if pattern == "*" {
+			wildcard = true
+			continue
+		}
+		if originMatches(pattern, origin) {
+			return origin
+		}
+	}
+	if wildcard {
+		return "*"
+	}
+	return ""
+}
+
+func originMatches(pattern, origin string) bool {
+	idx := strings.Index(pattern, "*")
+	if idx == -1 {
+		return strings.EqualFold(pattern, origin)
+	}
+
+	prefix, suffix := strings.ToLower(pattern[:idx]), strings.ToLower(pattern[idx+1:])
+	origin = strings.ToLower(origin)
+	if len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(sub, "/:.")
+}
+
+// Returns the CORS policy of the request route: the one of its nearest group
+// or the app one. Not matched requests use the policy of the first route
+// with the same path.
+func (r *Request) corsPolicy() *CORSPolicy {
+	entry := r.route
+	if entry == nil {
+		if matching := matchingRoutes(r.app.routes, r.Req); len(matching) > 0 {
+			entry = matching[0]
+		}
+	}
+	if entry != nil {
+		for g := entry.group; g != nil; g = g.parent {
+			if g.cors != nil {
+				return g.cors
+			}
+		}
+	}
+	return r.app.cors
+}
+
+// Emits the CORS headers of the cross-origin requests. It returns true if
+// the request was a preflight one, already answered.
+func (r *Request) handleCORS() bool {
+	p := r.corsPolicy()
+	if p == nil {
+		return false
+	}
+
+	// The response depends on the origin unless every one gets "*", even when
+	// it's missing or not allowed, so the caches don't mix them
+	header := r.W.Header()
+	if len(p.Origins) != 1 || p.Origins[0] != "*" {
+		addVary(header, "Origin")
+	}
+
+	origin := r.Req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	allowed := p.allowOrigin(origin)
+	if allowed == "" {
+		return false
+	}
+
+	header.Set("Access-Control-Allow-Origin", allowed)
+	if p.Credentials && allowed != "*" {
+		r.corsCreds = true
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	// Actual request
+	method := r.Req.Header.Get("Access-Control-Request-Method")
+	if r.Req.Method != "OPTIONS" || method == "" {
+		exposed := append([]string{}, p.ExposedHeaders...)
+		if r.corsCreds {
+			exposed = append(exposed, "X-Xsrf-Token")
+		}
+		if len(exposed) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+		}
+		return false
+	}
+
+	// Preflight request
+	methods := p.Methods
+	if len(methods) == 0 {
+		methods = allowedMethods(r.app.routes, r.Req)
+	}
+	if len(methods) == 0 {
+		methods = []string{method}
+	}
+	headers := p.Headers
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if p.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+	r.W.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOriginMatches(t *testing.T) {
+	tests := []struct {
+		pattern, origin string
+		expected        bool
+	}{
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "https://EXAMPLE.com", true},
+		{"https://example.com", "http://example.com", false},
+		{"https://*.example.com", "https://a.example.com", true},
+		{"https://*.example.com", "https://A.Example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://.example.com", false},
+		{"https://*.example.com", "https://evilexample.com", false},
+		{"https://*.example.com", "https://a.b.example.com", false},
+		{"https://*.example.com", "http://a.example.com", false},
+		{"https://*.example.com", "https://a.example.com:8080", false},
+		{"https://*.example.com", "https://evil.com/.example.com", false},
+		{"https://*.example.com", "https://evil.com:.example.com", false},
+	}
+	for _, test := range tests {
+		if got := originMatches(test.pattern, test.origin); got != test.expected {
+			t.Errorf("%s against %s: got %v, expected %v", test.origin, test.pattern,
+				got, test.expected)
+		}
+	}
+}
+
+func serveCORS(a *App, method, path, origin, requestMethod string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if requestMethod != "" {
+		req.Header.Set("Access-Control-Request-Method", requestMethod)
+	}
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCORSPreflight(t *testing.T) {
+	a := newTestApp(map[string]Handler{
+		"POST::/api/items":   okHandler,
+		"DELETE::/api/items": okHandler,
+	})
+	a.SetCORS(&CORSPolicy{
+		Origins:     []string{"https://*.example.com"},
+		Credentials: true,
+		MaxAge:      10 * time.Minute,
+	})
+
+	rec := serveCORS(a, "OPTIONS", "/api/items", "https://m.example.com", "POST")
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://m.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "DELETE, OPTIONS, POST",
+		"Access-Control-Allow-Headers":     "Content-Type, Authorization, X-Xsrf-Token",
+		"Access-Control-Max-Age":           "600",
+		"Vary":                             "Origin",
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("status %d, expected 204", rec.Code)
+	}
+	for name, value := range expected {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("header %s: got %q, expected %q", name, got, value)
+		}
+	}
+
+	rec = serveCORS(a, "OPTIONS", "/api/items", "https://evilexample.com", "POST")
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("origin %q allowed for a not allowed origin", origin)
+	}
+	if vary := rec.Header().Get("Vary"); vary != "Origin" {
+		t.Errorf("vary %q in a not allowed origin, expected Origin", vary)
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	tests := []struct {
+		origins     []string
+		origin      string
+		allowed     string
+		credentials string
+		vary        string
+	}{
+		{[]string{"*"}, "https://other.com", "*", "", ""},
+		{[]string{"*"}, "", "", "", ""},
+		{[]string{"https://example.com", "*"}, "https://example.com", "https://example.com", "true", "Origin"},
+		{[]string{"https://example.com", "*"}, "https://other.com", "*", "", "Origin"},
+		{[]string{"https://example.com"}, "", "", "", "Origin"},
+	}
+	for _, test := range tests {
+		a := newTestApp(map[string]Handler{"::/api": okHandler})
+		a.SetCORS(&CORSPolicy{Origins: test.origins, Credentials: true})
+
+		rec := serveCORS(a, "GET", "/api", test.origin, "")
+		if rec.Code != http.StatusOK {
+			t.Errorf("%v %s: status %d, expected 200", test.origins, test.origin, rec.Code)
+		}
+		h := rec.Header()
+		if got := h.Get("Access-Control-Allow-Origin"); got != test.allowed {
+			t.Errorf("%v %s: allowed origin %q, expected %q", test.origins, test.origin,
+				got, test.allowed)
+		}
+		if got := h.Get("Access-Control-Allow-Credentials"); got != test.credentials {
+			t.Errorf("%v %s: credentials %q, expected %q", test.origins, test.origin,
+				got, test.credentials)
+		}
+		if got := h.Get("Vary"); got != test.vary {
+			t.Errorf("%v %s: vary %q, expected %q", test.origins, test.origin, got, test.vary)
+		}
+	}
+}
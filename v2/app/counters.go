@@ -0,0 +1,165 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// CounterStore keeps the counters of the rate limiters and the error reports.
+// The methods mirror the memcache ones, so any similar backend can be adapted.
+type CounterStore interface {
+	// Adds delta to the counter of the key, creating it with the expiration
+	// if it doesn't exist, and returns the new value.
+	Increment(c appengine.Context, key string, delta int64, expiration time.Duration) (int64, error)
+
+	// Returns the value of the key and an opaque version to pass to
+	// CompareAndSwap, or a nil value if it doesn't exist.
+	Get(c appengine.Context, key string) ([]byte, interface{}, error)
+
+	// Saves the value if the key has not changed since Get returned the
+	// version. It returns false if it changed.
+	CompareAndSwap(c appengine.Context, key string, value []byte, version interface{}, expiration time.Duration) (bool, error)
+}
+
+// MemoryCounterStore keeps the counters in the instance memory. Every
+// instance has its own counts, so a rate limit is multiplied by the number of
+// instances.
+type MemoryCounterStore struct {
+	mutex sync.Mutex
+	items map[string]*memoryCounterItem
+	ops   int
+}
+
+type memoryCounterItem struct {
+	value   []byte
+	version int64
+	expires time.Time
+}
+
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{items: map[string]*memoryCounterItem{}}
+}
+
+// Returns the item of the key if it has not expired. The mutex must be held.
+func (s *MemoryCounterStore) item(key string, now time.Time) *memoryCounterItem {
+	// Remove the expired items from time to time
+	s.ops++
+	if s.ops%1000 == 0 {
+		for k, item := range s.items {
+			if now.After(item.expires) {
+				delete(s.items, k)
+			}
+		}
+	}
+
+	item, ok := s.items[key]
+	if !ok || now.After(item.expires) {
+		return nil
+	}
+	return item
+}
+
+func (s *MemoryCounterStore) Increment(c appengine.Context, key string, delta int64, expiration time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	item := s.item(key, now)
+	if item == nil {
+		item = &memoryCounterItem{value: []byte("0"), expires: now.Add(expiration)}
+		s.items[key] = item
+	}
+	n, err := strconv.ParseInt(string(item.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("counter %s is not a number: %s", key, err)
+	}
+	n += delta
+	item.value = []byte(strconv.FormatInt(n, 10))
+	item.version++
+	return n, nil
+}
+
+func (s *MemoryCounterStore) Get(c appengine.Context, key string) ([]byte, interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item := s.item(key, time.Now())
+	if item == nil {
+		return nil, nil, nil
+	}
+	return item.value, item.version, nil
+}
+
+func (s *MemoryCounterStore) CompareAndSwap(c appengine.Context, key string, value []byte, version interface{}, expiration time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	item := s.item(key, now)
+	if item == nil {
+		if version != nil {
+			return false, nil
+		}
+		item = &memoryCounterItem{}
+		s.items[key] = item
+	} else if version == nil || item.version != version.(int64) {
+		return false, nil
+	}
+
+	item.value = value
+	item.version++
+	item.expires = now.Add(expiration)
+	return true, nil
+}
+
+// MemcacheCounterStore keeps the counters in the App Engine memcache,
+// shared by all the instances.
+type MemcacheCounterStore struct{}
+
+func (s MemcacheCounterStore) Increment(c appengine.Context, key string, delta int64, expiration time.Duration) (int64, error) {
+	// Create the counter with its expiration, Increment can't set it
+	err := memcache.Add(c, &memcache.Item{Key: key, Value: []byte("0"), Expiration: expiration})
+	if err != nil && err != memcache.ErrNotStored {
+		return 0, fmt.Errorf("add counter failed: %s", err)
+	}
+
+	n, err := memcache.Increment(c, key, delta, 0)
+	if err != nil {
+		return 0, fmt.Errorf("increment counter failed: %s", err)
+	}
+	return int64(n), nil
+}
+
+func (s MemcacheCounterStore) Get(c appengine.Context, key string) ([]byte, interface{}, error) {
+	item, err := memcache.Get(c, key)
+	if err == memcache.ErrCacheMiss {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("get item failed: %s", err)
+	}
+	return item.Value, item, nil
+}
+
+func (s MemcacheCounterStore) CompareAndSwap(c appengine.Context, key string, value []byte, version interface{}, expiration time.Duration) (bool, error) {
+	var err error
+	if version == nil {
+		err = memcache.Add(c, &memcache.Item{Key: key, Value: value, Expiration: expiration})
+	} else {
+		item := version.(*memcache.Item)
+		item.Value = value
+		item.Expiration = expiration
+		err = memcache.CompareAndSwap(c, item)
+	}
+
+	if err == memcache.ErrNotStored || err == memcache.ErrCASConflict {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("compare and swap item failed: %s", err)
+	}
+	return true, nil
+}
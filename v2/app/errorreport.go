@@ -0,0 +1,436 @@
+package app
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"time"
+
+	"appengine"
+)
+
+// The errors are fingerprinted (see errorFingerprint) and counted in the
+// error store of the app. The first occurrence of each one is reported right
+// away, and then they're reported in digests by the ErrorDigest handler.
+//
+// Every error has its own counter ("errors:count:<fingerprint>") and info
+// ("errors:info:<fingerprint>", with the sampled routes and requests). The
+// index ("errors:index") lists the fingerprints counted since the last
+// digest, and only changes the first time each one happens in the period.
+
+// Time an error fingerprint is remembered. It's reported again if it happens
+// after that.
+var ErrorFingerprintTTL = 24 * time.Hour
+
+const (
+	errorIndexKey   = "errors:index"
+	errorDroppedKey = "errors:dropped"
+	errorDigestTTL  = 7 * 24 * time.Hour
+
+	maxDigestErrors   = 100
+	maxDigestRoutes   = 10
+	maxDigestRequests = 5
+	maxDigestMessage  = 1000
+)
+
+var (
+	errorNumbersRe = regexp.MustCompile(`\b[0-9a-fA-F]*[0-9][0-9a-fA-F]*\b`)
+	errorQuotedRe  = regexp.MustCompile(`"[^"]*"`)
+)
+
+// Fingerprints counted since the last digest, saved as JSON in the store.
+type errorIndex struct {
+	Since        time.Time
+	Fingerprints []string
+}
+
+// Info of an error, saved as JSON in the store. The routes and requests are
+// sampled: the first occurrences and then the powers of two.
+type errorInfo struct {
+	Message     string
+	Location    string
+	Severity    Severity
+	Routes      []string
+	Requests    []string
+	First, Last time.Time
+}
+
+// Returns the fingerprint of the error: a hash of the message, without the
+// numbers and quoted values that change between occurrences, and the
+// location of the code that produced it.
+func errorFingerprint(err error, location string) string {
+	msg := errorQuotedRe.ReplaceAllString(err.Error(), `"?"`)
+	msg = errorNumbersRe.ReplaceAllString(msg, "N")
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s", msg, location)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Returns the function where the error was built if it has a stack, or the
+// fallback location otherwise.
+func errorLocation(err error, fallback string) string {
+	var e *Error
+	if !errors.As(err, &e) || len(e.stack) == 0 {
+		return fallback
+	}
+	frame, _ := runtime.CallersFrames(e.stack).Next()
+	return frame.Function
+}
+
+// Returns the function that called the current one, skipping the frames.
+func callerLocation(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return ""
+	}
+	return f.Name()
+}
+
+// Returns the handler function of the route of the request, the location of
+// the plain errors it returns.
+func (r *Request) handlerLocation() string {
+	if r.route == nil || r.route.handler == nil {
+		return ""
+	}
+	f := runtime.FuncForPC(reflect.ValueOf(r.route.handler).Pointer())
+	if f == nil {
+		return ""
+	}
+	return f.Name()
+}
+
+// Changes the store where the errors are counted. The default one is the
+// memcache, shared by all the instances.
+func (a *App) SetErrorStore(s CounterStore) {
+	a.errorStore = s
+}
+
+// Counts the error, reporting it if it's the first occurrence. The location
+// is used if the error has no stack.
+func (r *Request) reportError(err error, details, location string) {
+	store := r.app.errorStore
+	location = errorLocation(err, location)
+	fingerprint := errorFingerprint(err, location)
+	severity := codeSeverity(ErrorCode(err))
+	now := time.Now()
+
+	route := r.Req.URL.Path
+	if r.route != nil {
+		route = r.route.path
+	}
+
+	n, storeErr := store.Increment(r.C, "errors:seen:"+fingerprint, 1,
+		ErrorFingerprintTTL)
+	if storeErr != nil {
+		r.C.Errorf("[errors] count error failed: %s", storeErr)
+		return
+	}
+	if n == 1 {
+		r.app.report(r.C, &ErrorReport{
+			Severity:    severity,
+			Time:        now,
+			Error:       details,
+			Code:        ErrorCode(err),
+			Fingerprint: fingerprint,
+			RequestID:   r.id,
+			Route:       route,
+			User:        r.user,
+		})
+	}
+
+	countKey := "errors:count:" + fingerprint
+	count, storeErr := store.Increment(r.C, countKey, 1, errorDigestTTL)
+	if storeErr != nil {
+		r.C.Errorf("[errors] count error failed: %s", storeErr)
+		return
+	}
+	if count == 1 {
+		// First time in this period, add it to the index
+		indexed, storeErr := indexError(r.C, store, fingerprint, now)
+		if storeErr != nil {
+			r.C.Errorf("[errors] index error failed: %s", storeErr)
+			return
+		}
+		if !indexed {
+			// Too many different errors, count it apart and try again the next
+			// time it happens
+			if _, storeErr := store.Increment(r.C, countKey, -1, errorDigestTTL); storeErr != nil {
+				r.C.Errorf("[errors] uncount error failed: %s", storeErr)
+			}
+			if _, storeErr := store.Increment(r.C, errorDroppedKey, 1, errorDigestTTL); storeErr != nil {
+				r.C.Errorf("[errors] count dropped error failed: %s", storeErr)
+			}
+			return
+		}
+	}
+
+	if count <= maxDigestRequests || count&(count-1) == 0 {
+		info := &errorInfo{
+			Message:  err.Error(),
+			Location: location,
+			Severity: severity,
+		}
+		if len(info.Message) > maxDigestMessage {
+			info.Message = info.Message[:maxDigestMessage] + "..."
+		}
+		if storeErr := sampleError(r.C, store, fingerprint, info, route, r.id, now); storeErr != nil {
+			r.C.Errorf("[errors] sample error failed: %s", storeErr)
+		}
+	}
+}
+
+// Adds the fingerprint to the index. It returns false if the index is full.
+func indexError(c appengine.Context, store CounterStore, fingerprint string, now time.Time) (bool, error) {
+	for i := 0; i < 5; i++ {
+		value, version, err := store.Get(c, errorIndexKey)
+		if err != nil {
+			return false, fmt.Errorf("get index failed: %s", err)
+		}
+		index := &errorIndex{Since: now}
+		if value != nil {
+			if err := json.Unmarshal(value, index); err != nil {
+				c.Errorf("[errors] malformed index discarded: %s", err)
+				index = &errorIndex{Since: now}
+			}
+		}
+
+		for _, f := range index.Fingerprints {
+			if f == fingerprint {
+				return true, nil
+			}
+		}
+		if len(index.Fingerprints) >= maxDigestErrors {
+			return false, nil
+		}
+		index.Fingerprints = append(index.Fingerprints, fingerprint)
+
+		data, err := json.Marshal(index)
+		if err != nil {
+			return false, fmt.Errorf("marshal index failed: %s", err)
+		}
+		ok, err := store.CompareAndSwap(c, errorIndexKey, data, version,
+			errorDigestTTL)
+		if err != nil {
+			return false, fmt.Errorf("save index failed: %s", err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("too much contention in the index")
+}
+
+// Adds the route and the request to the info of the error, creating it from
+// the empty one if needed. It's a sample, so it's not retried if other
+// request changes the info at the same time.
+func sampleError(c appengine.Context, store CounterStore, fingerprint string, empty *errorInfo, route, requestID string, now time.Time) error {
+	key := "errors:info:" + fingerprint
+	value, version, err := store.Get(c, key)
+	if err != nil {
+		return fmt.Errorf("get info failed: %s", err)
+	}
+	info := empty
+	if value != nil {
+		info = &errorInfo{}
+		if err := json.Unmarshal(value, info); err != nil {
+			c.Errorf("[errors] malformed info discarded: %s", err)
+			info = empty
+		}
+	}
+
+	if info.First.IsZero() {
+		info.First = now
+	}
+	info.Last = now
+	if len(info.Requests) < maxDigestRequests {
+		info.Requests = append(info.Requests, requestID)
+	}
+	found := false
+	for _, r := range info.Routes {
+		if r == route {
+			found = true
+		}
+	}
+	if !found && len(info.Routes) < maxDigestRoutes {
+		info.Routes = append(info.Routes, route)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("marshal info failed: %s", err)
+	}
+	if _, err := store.CompareAndSwap(c, key, data, version, errorDigestTTL); err != nil {
+		return fmt.Errorf("save info failed: %s", err)
+	}
+	return nil
+}
+
+// Returns the value of a counter of the store, zero if it doesn't exist.
+func getCounter(c appengine.Context, store CounterStore, key string) (int64, error) {
+	value, _, err := store.Get(c, key)
+	if err != nil || value == nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("counter %s is not a number: %s", key, err)
+	}
+	return n, nil
+}
+
+// Reports the digest of the errors counted since the last call, if there are
+// any. Run it periodically from cron:
+//    "GET::/tasks/error-digest": app.ErrorDigest,
+//
+//    # cron.yaml
+//    - description: errors digest
+//      url: /tasks/error-digest
+//      schedule: every 1 hours
+func ErrorDigest(r *Request) error {
+	store := r.app.errorStore
+	now := time.Now()
+
+	// Replace the index with an empty one, keeping the old one
+	var index *errorIndex
+	for i := 0; ; i++ {
+		if i == 5 {
+			return fmt.Errorf("too much contention in the errors index")
+		}
+
+		value, version, err := store.Get(r.C, errorIndexKey)
+		if err != nil {
+			return fmt.Errorf("get index failed: %s", err)
+		}
+		if value == nil {
+			return nil
+		}
+		index = &errorIndex{}
+		if err := json.Unmarshal(value, index); err != nil {
+			return fmt.Errorf("decode index failed: %s", err)
+		}
+		if len(index.Fingerprints) == 0 {
+			return nil
+		}
+
+		empty, err := json.Marshal(&errorIndex{Since: now})
+		if err != nil {
+			return fmt.Errorf("marshal index failed: %s", err)
+		}
+		ok, err := store.CompareAndSwap(r.C, errorIndexKey, empty, version,
+			errorDigestTTL)
+		if err != nil {
+			return fmt.Errorf("reset index failed: %s", err)
+		}
+		if ok {
+			break
+		}
+	}
+
+	report := &ErrorReport{
+		Severity: SeverityWarning,
+		Time:     now,
+		Since:    index.Since,
+		Digest:   []*ErrorDigestEntry{},
+	}
+	for _, fingerprint := range index.Fingerprints {
+		entry, err := takeErrorCount(r.C, store, fingerprint, now)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		report.Digest = append(report.Digest, entry)
+		if entry.Severity > report.Severity {
+			report.Severity = entry.Severity
+		}
+	}
+
+	dropped, err := getCounter(r.C, store, errorDroppedKey)
+	if err != nil {
+		return fmt.Errorf("get dropped errors failed: %s", err)
+	}
+	if dropped > 0 {
+		if _, err := store.Increment(r.C, errorDroppedKey, -dropped, errorDigestTTL); err != nil {
+			return fmt.Errorf("reset dropped errors failed: %s", err)
+		}
+		report.Dropped = int(dropped)
+	}
+
+	if len(report.Digest) == 0 && report.Dropped == 0 {
+		return nil
+	}
+	report.sortDigest()
+	r.app.report(r.C, report)
+	return nil
+}
+
+// Returns the digest entry of the error and subtracts the reported count and
+// samples. If it happened again meanwhile it's added to the new index.
+func takeErrorCount(c appengine.Context, store CounterStore, fingerprint string, now time.Time) (*ErrorDigestEntry, error) {
+	countKey := "errors:count:" + fingerprint
+	count, err := getCounter(c, store, countKey)
+	if err != nil {
+		return nil, fmt.Errorf("get error count failed: %s", err)
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+	left, err := store.Increment(c, countKey, -count, errorDigestTTL)
+	if err != nil {
+		return nil, fmt.Errorf("reset error count failed: %s", err)
+	}
+	if left > 0 {
+		if _, err := indexError(c, store, fingerprint, now); err != nil {
+			return nil, fmt.Errorf("index error again failed: %s", err)
+		}
+	}
+
+	infoKey := "errors:info:" + fingerprint
+	value, version, err := store.Get(c, infoKey)
+	if err != nil {
+		return nil, fmt.Errorf("get error info failed: %s", err)
+	}
+	info := &errorInfo{}
+	if value != nil {
+		if err := json.Unmarshal(value, info); err != nil {
+			c.Errorf("[errors] malformed info discarded: %s", err)
+		}
+
+		// Start the samples again, a conflict only keeps some of them
+		empty, err := json.Marshal(&errorInfo{
+			Message:  info.Message,
+			Location: info.Location,
+			Severity: info.Severity,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("marshal error info failed: %s", err)
+		}
+		if _, err := store.CompareAndSwap(c, infoKey, empty, version, errorDigestTTL); err != nil {
+			return nil, fmt.Errorf("reset error info failed: %s", err)
+		}
+	}
+
+	return &ErrorDigestEntry{
+		Fingerprint: fingerprint,
+		Message:     info.Message,
+		Location:    info.Location,
+		Severity:    info.Severity,
+		Count:       int(count),
+		Routes:      info.Routes,
+		Requests:    info.Requests,
+		First:       info.First,
+		Last:        info.Last,
+	}, nil
+}
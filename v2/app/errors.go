@@ -1,39 +1,194 @@
 package app
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
 
 	"appengine"
 	"appengine/taskqueue"
 )
 
+// Error is an HTTP error returned by the handlers. It keeps apart the
+// internal cause, that it's logged, from the message and the field details
+// that can be shown to the user.
+type Error struct {
+	Code int
+
+	// Internal reason of the error, not shown to the user
+	Cause error
+
+	// Safe message for the user; the status text of the code if empty
+	Message string
+
+	// Messages of the invalid fields of the request, by name
+	Fields map[string]string
+
+	stack []uintptr
+}
+
+// Builds a new error with the status code, capturing the call stack. The
+// reasons are joined like fmt.Sprintln does, but a single error reason is kept
+// as the cause so it can be unwrapped.
+func NewError(code int, reasons ...interface{}) *Error {
+	return newError(code, reasons)
+}
+
+// Skips the frames of the constructors, they must call it directly.
+func newError(code int, reasons []interface{}) *Error {
+	e := &Error{Code: code, stack: make([]uintptr, 32)}
+	e.stack = e.stack[:runtime.Callers(3, e.stack)]
+
+	if len(reasons) == 1 {
+		if err, ok := reasons[0].(error); ok {
+			e.Cause = err
+			return e
+		}
+	}
+	if len(reasons) > 0 {
+		e.Cause = errors.New(strings.TrimSuffix(fmt.Sprintln(reasons...), "\n"))
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Cause == nil {
+		return fmt.Sprintf("http error %d", e.Code)
+	}
+	return fmt.Sprintf("http error %d: %s", e.Code, e.Cause)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Matches the HttpError of the same code. The constructors return a new
+// error each time, so compare them with errors.Is instead of ==:
+//    if errors.Is(err, app.HttpError(404)) { ... }
+func (e *Error) Is(target error) bool {
+	code, ok := target.(HttpError)
+	return ok && int(code) == e.Code
+}
+
+// Sets the message shown to the user.
+func (e *Error) Public(message string) *Error {
+	e.Message = message
+	return e
+}
+
+// Adds the message of an invalid field of the request.
+func (e *Error) Field(name, message string) *Error {
+	if e.Fields == nil {
+		e.Fields = map[string]string{}
+	}
+	e.Fields[name] = message
+	return e
+}
+
+// Returns the message shown to the user.
+func (e *Error) PublicMessage() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return http.StatusText(e.Code)
+}
+
+// Returns the call stack where the error was built.
+func (e *Error) Stack() string {
+	buf := []string{}
+	frames := runtime.CallersFrames(e.stack)
+	for {
+		frame, more := frames.Next()
+		buf = append(buf, fmt.Sprintf("%s\n\t%s:%d", frame.Function, frame.File,
+			frame.Line))
+		if !more {
+			break
+		}
+	}
+	return strings.Join(buf, "\n")
+}
+
+// Builds the 500 error of a recovered panic, with the stack of the code that
+// panicked. It must be called from the deferred function.
+func panicError(rec interface{}) *Error {
+	e := &Error{
+		Code:  500,
+		Cause: fmt.Errorf("panic recovered error: %v", rec),
+		stack: make([]uintptr, 32),
+	}
+	e.stack = e.stack[:runtime.Callers(1, e.stack)]
+
+	// Drop the frames of the recovery and the runtime panic ones
+	panicking := false
+	for i, pc := range e.stack {
+		frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+		if frame.Function == "runtime.gopanic" {
+			panicking = true
+		} else if panicking && !strings.HasPrefix(frame.Function, "runtime.") {
+			e.stack = e.stack[i:]
+			break
+		}
+	}
+	return e
+}
+
+// Returns the status code of the error: the one of an *Error or HttpError in
+// its chain, or 500 otherwise.
+func ErrorCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	var code HttpError
+	if errors.As(err, &code) {
+		return int(code)
+	}
+	return 500
+}
+
+// HttpError is the bare status code error of the old versions, use NewError
+// in new code. It's still the target to check the code of the errors with
+// errors.Is, see Error.Is.
 type HttpError int
 
 func (e HttpError) Error() string {
 	return fmt.Sprintf("http error %d", e)
 }
 
-func Forbidden() error {
-	return HttpError(403)
+func BadRequest(reasons ...interface{}) *Error {
+	return newError(400, reasons)
+}
+
+func Unauthorized(reasons ...interface{}) *Error {
+	return newError(401, reasons)
+}
+
+func Forbidden(reasons ...interface{}) *Error {
+	return newError(403, reasons)
+}
+
+func NotFound(reasons ...interface{}) *Error {
+	return newError(404, reasons)
 }
 
-func NotFound() error {
-	return HttpError(404)
+func NotAllowed(reasons ...interface{}) *Error {
+	return newError(405, reasons)
 }
 
-func NotAllowed() error {
-	return HttpError(405)
+func TooManyRequests(reasons ...interface{}) *Error {
+	return newError(429, reasons)
 }
 
-func sendErrorByEmail(c appengine.Context, errorStr string) {
+func sendErrorByEmail(c appengine.Context, values map[string]string) error {
 	if appengine.IsDevAppServer() {
-		return
+		return nil
 	}
 
-	t := NewTask("/tasks/error-mail", map[string]string{
-		"Error": errorStr,
-	})
+	t := NewTask("/tasks/error-mail", values)
 	if _, err := taskqueue.Add(c, t, "admin-mails"); err != nil {
-		c.Errorf("cannot prepare error mail: %s", err.Error())
+		return fmt.Errorf("cannot prepare error mail: %s", err)
 	}
+	return nil
 }
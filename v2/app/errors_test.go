@@ -0,0 +1,31 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorIsHttpError(t *testing.T) {
+	err := fmt.Errorf("load user failed: %w", NotFound("no user 42"))
+	if !errors.Is(err, HttpError(404)) {
+		t.Errorf("wrapped 404 doesn't match HttpError(404)")
+	}
+	if errors.Is(err, HttpError(403)) {
+		t.Errorf("404 matches HttpError(403)")
+	}
+	if ErrorCode(err) != 404 {
+		t.Errorf("code %d, expected 404", ErrorCode(err))
+	}
+}
+
+func TestErrorUnwrapsCause(t *testing.T) {
+	cause := errors.New("datastore timeout")
+	err := NewError(503, cause)
+	if !errors.Is(err, cause) {
+		t.Errorf("error doesn't unwrap to its cause")
+	}
+	if err.PublicMessage() != "Service Unavailable" {
+		t.Errorf("public message %q, expected the status text", err.PublicMessage())
+	}
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Group is a set of routes sharing a path prefix and a middlewares stack.
+// The routes are registered in their own mux subrouter, and the group
+// middlewares run after the global ones of the app. Mux tries them after
+// every route registered before the group, so a variable route of the app
+// like "/_/admin/{page}" takes the requests of "/_/admin/users" in the group
+// (it is logged when the group is registered).
+//
+// Example:
+//    a := app.NewApp(routes)
+//    admin := a.Group("/_/admin", map[string]app.Handler{
+//      "::/": admin.Dashboard,
+//      "POST::/users": admin.SaveUser,
+//    }, auth.Admin)
+//    admin.Group("/reports", reports, auth.Accounting)
+//
+type Group struct {
+	app         *App
+	parent      *Group
+	router      *mux.Router
+	prefix      string
+	middlewares []Middleware
+	xsrfExempt  bool
+	cors        *CORSPolicy
+	api         bool
+}
+
+// Registers a new group of routes in the app. The routes map has the same
+// format as the NewApp one, with paths relative to the prefix. It panics on
+// ERROR entries: the error handlers are global and the group middlewares
+// would guard them for the whole app, set them in NewApp instead.
+func (a *App) Group(prefix string, routes map[string]Handler, mws ...Middleware) *Group {
+	return newGroup(a, nil, a.router, prefix, prefix, routes, mws)
+}
+
+// Registers a nested group of routes. Its prefix and middlewares are appended
+// to the ones of the parent group.
+func (g *Group) Group(prefix string, routes map[string]Handler, mws ...Middleware) *Group {
+	all := make([]Middleware, 0, len(g.middlewares)+len(mws))
+	all = append(all, g.middlewares...)
+	all = append(all, mws...)
+	return newGroup(g.app, g, g.router, prefix, g.prefix+prefix, routes, all)
+}
+
+// Exempts all the routes of the group, including the nested ones, from the
+// XSRF check. Use it for groups of webhooks or token authenticated APIs.
+func (g *Group) ExemptXSRF() {
+	g.xsrfExempt = true
+}
+
+// Sets the CORS policy of the routes of the group, including the nested ones
+// without their own policy. It overrides the one of the app.
+func (g *Group) SetCORS(p *CORSPolicy) {
+	g.cors = p
+}
+
+func newGroup(a *App, parent *Group, router *mux.Router, prefix, fullPrefix string, routes map[string]Handler, mws []Middleware) *Group {
+	g := &Group{
+		app:         a,
+		parent:      parent,
+		router:      router.PathPrefix(prefix).Subrouter(),
+		prefix:      fullPrefix,
+		middlewares: mws,
+	}
+	a.handle(g.router, g, routes)
+	return g
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/gorilla/sessions"
+)
+
+// Middleware decorates a handler with some cross-cutting behaviour (auth,
+// logging, tenant checks, ...). It should call h to continue the chain or
+// return an error to stop it.
+type Middleware func(h Handler) Handler
+
+// Returns the handler decorated with the middlewares, the first one being the
+// outermost. Use it to attach middlewares to a single entry of the routes map:
+//    "POST::/_/admin/users": app.With(users.Save, auth.Admin),
+func With(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Returns the built-in middlewares that every new app runs by default, in
+// order. XSRF needs the secret saved in the session, so it should come after
+// Sessions.
+func DefaultMiddlewares() []Middleware {
+	return []Middleware{Recovery, CompatHeaders, Sessions, XSRF}
+}
+
+// Converts the panics of the rest of the chain into errors.
+func Recovery(h Handler) Handler {
+	return func(r *Request) (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = panicError(rec)
+			}
+		}()
+		return h(r)
+	}
+}
+
+// Emits the compatibility header for IE (you can overwrite it from the
+// handlers if needed). The cache headers come from the CachePolicy.
+func CompatHeaders(h Handler) Handler {
+	return func(r *Request) error {
+		r.W.Header().Set("X-UA-Compatible", "chrome=1")
+		return h(r)
+	}
+}
+
+// Loads the session before the handler and saves it just before committing
+// the response, so the cookie is never lost (redirects, errors, ...).
+func Sessions(h Handler) Handler {
+	return func(r *Request) error {
+		session, err := getSession(r.app.sessionStore, r.app.sessionOpts, r.Req)
+		if err != nil {
+			return fmt.Errorf("build session failed: %s", err)
+		}
+		r.Session = session
+
+		r.BeforeCommit(func() error {
+			if err := sessions.Save(r.Req, r.W); err != nil {
+				return fmt.Errorf("save session failed: %s", err)
+			}
+			return nil
+		})
+		return h(r)
+	}
+}
+
+// Streams the whole response of the route, see Request.Stream. Use it for
+// downloads, exports and server-sent events.
+func Streaming(h Handler) Handler {
+	return func(r *Request) error {
+		if err := r.Stream(); err != nil {
+			return err
+		}
+		return h(r)
+	}
+}
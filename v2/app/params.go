@@ -0,0 +1,88 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+
+	"appengine/datastore"
+
+	"github.com/gorilla/mux"
+)
+
+// Path parameters come from the route template (e.g. "/users/{id}"). A
+// malformed one means the URL doesn't point to anything, so the accessors
+// return a 404 error.
+
+// Returns the value of the path parameter, or an empty string if the route
+// has no parameter with that name.
+func (r *Request) Param(name string) string {
+	return mux.Vars(r.Req)[name]
+}
+
+func (r *Request) IntParam(name string) (int, error) {
+	n, err := r.Int64Param(name)
+	return int(n), err
+}
+
+func (r *Request) Int64Param(name string) (int64, error) {
+	n, err := strconv.ParseInt(r.Param(name), 10, 64)
+	if err != nil {
+		return 0, NotFound(fmt.Errorf("malformed int path param %s: %s", name, err))
+	}
+	return n, nil
+}
+
+// Decodes a datastore key from the path parameter. If kind is not empty the
+// key must also be of that kind.
+func (r *Request) KeyParam(name, kind string) (*datastore.Key, error) {
+	key, err := datastore.DecodeKey(r.Param(name))
+	if err != nil {
+		return nil, NotFound(fmt.Errorf("malformed key path param %s: %s", name, err))
+	}
+	if kind != "" && key.Kind() != kind {
+		return nil, NotFound(fmt.Errorf("key path param %s of kind %s, expected %s",
+			name, key.Kind(), kind))
+	}
+	return key, nil
+}
+
+// Query parameters are optional: the accessors return the zero value if they
+// are missing or empty, and a 400 error if they are malformed.
+
+// Returns the value of the query (or form) parameter.
+func (r *Request) Query(name string) string {
+	return r.Req.FormValue(name)
+}
+
+func (r *Request) IntQuery(name string) (int, error) {
+	n, err := r.Int64Query(name)
+	return int(n), err
+}
+
+func (r *Request) Int64Query(name string) (int64, error) {
+	value := r.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, BadRequest(fmt.Errorf("malformed int query param %s: %s", name, err)).
+			Field(name, "Must be an integer")
+	}
+	return n, nil
+}
+
+func (r *Request) BoolQuery(name string) (bool, error) {
+	value := r.Query(name)
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, BadRequest(fmt.Errorf("malformed bool query param %s: %s", name,
+			err)).Field(name, "Must be a boolean")
+	}
+	return b, nil
+}
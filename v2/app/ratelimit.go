@@ -0,0 +1,190 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+)
+
+// Algorithms of the rate limiters.
+type RateLimitAlgorithm int
+
+const (
+	// Counts the requests in consecutive windows of fixed length
+	FixedWindow RateLimitAlgorithm = iota
+
+	// Refills the bucket continuously, allowing bursts of Limit requests
+	TokenBucket
+)
+
+// RateLimit describes a rate limiter, see RateLimiter.
+type RateLimit struct {
+	// Namespace of the counters, to keep the limiters apart
+	Name string
+
+	// Returns the key of the client to limit; KeyByIP if nil
+	Key func(r *Request) string
+
+	Algorithm RateLimitAlgorithm
+
+	// Requests allowed per window. For the token bucket, capacity of the
+	// bucket; it's refilled completely in a window.
+	Limit  int
+	Window time.Duration
+
+	// Backend of the counters; DefaultRateLimitStore if nil
+	Store RateLimitStore
+}
+
+// The rate limiters stores were named after them before the errors reporting
+// shared them, the old names are kept for compatibility.
+type (
+	RateLimitStore         = CounterStore
+	MemoryRateLimitStore   = MemoryCounterStore
+	MemcacheRateLimitStore = MemcacheCounterStore
+)
+
+var NewMemoryRateLimitStore = NewMemoryCounterStore
+
+// Store of the rate limiters without their own one.
+var DefaultRateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+
+// Returns the client IP as the rate limit key.
+func KeyByIP(r *Request) string {
+	ip := r.Req.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return "ip:" + ip
+}
+
+// Returns the session ID as the rate limit key, or the client IP if the
+// session has not been saved yet.
+func KeyBySession(r *Request) string {
+	if r.Session == nil || r.Session.ID == "" {
+		return KeyByIP(r)
+	}
+	return "session:" + r.Session.ID
+}
+
+// Returns the user recorded with SetUser as the rate limit key, falling back
+// to KeyBySession for anonymous requests. The limiter must run after the
+// middleware that authenticates the user.
+func KeyByUser(r *Request) string {
+	if r.user == "" {
+		return KeyBySession(r)
+	}
+	return "user:" + r.user
+}
+
+// Rejects the requests over the limit with a 429 error (see "ERROR::429")
+// and a Retry-After header. It must run after Sessions to limit by session.
+// The requests are allowed if the store fails. It panics if the limit or the
+// window are not positive. Example:
+//    "POST::/login": app.With(auth.Login, app.RateLimiter(&app.RateLimit{
+//      Name:   "login",
+//      Limit:  5,
+//      Window: time.Minute,
+//    })),
+func RateLimiter(l *RateLimit) Middleware {
+	if l.Limit <= 0 || l.Window <= 0 {
+		panic(fmt.Sprintf("rate limit %s needs a positive limit and window, "+
+			"got %d per %s", l.Name, l.Limit, l.Window))
+	}
+
+	return func(h Handler) Handler {
+		return func(r *Request) error {
+			retry, err := l.allow(r)
+			if err != nil {
+				r.LogError(fmt.Errorf("rate limiter %s failed: %s", l.Name, err))
+				return h(r)
+			}
+			if retry > 0 {
+				r.W.Header().Set("Retry-After",
+					strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+				return TooManyRequests()
+			}
+			return h(r)
+		}
+	}
+}
+
+// Consumes a request from the limit. It returns the time to wait before
+// retrying if the request is not allowed.
+func (l *RateLimit) allow(r *Request) (time.Duration, error) {
+	keyFunc := l.Key
+	if keyFunc == nil {
+		keyFunc = KeyByIP
+	}
+	store := l.Store
+	if store == nil {
+		store = DefaultRateLimitStore
+	}
+	key := "ratelimit:" + l.Name + ":" + keyFunc(r)
+	now := time.Now()
+
+	if l.Algorithm == TokenBucket {
+		return l.allowTokenBucket(r.C, store, key, now)
+	}
+
+	// Fixed window
+	window := now.UnixNano() / int64(l.Window)
+	end := time.Unix(0, (window+1)*int64(l.Window))
+	count, err := store.Increment(r.C, key+":"+strconv.FormatInt(window, 10), 1,
+		end.Sub(now))
+	if err != nil {
+		return 0, err
+	}
+	if count > int64(l.Limit) {
+		return end.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// Takes a token of the bucket saved as "tokens:unix-nanos", retrying if
+// other request changes it at the same time.
+func (l *RateLimit) allowTokenBucket(c appengine.Context, store CounterStore, key string, now time.Time) (time.Duration, error) {
+	rate := float64(l.Limit) / l.Window.Seconds()
+	for i := 0; i < 5; i++ {
+		value, version, err := store.Get(c, key)
+		if err != nil {
+			return 0, err
+		}
+
+		tokens := float64(l.Limit)
+		if value != nil {
+			parts := strings.Split(string(value), ":")
+			if len(parts) != 2 {
+				return 0, fmt.Errorf("malformed bucket: %q", value)
+			}
+			saved, err := strconv.ParseFloat(parts[0], 64)
+			if err != nil {
+				return 0, fmt.Errorf("malformed bucket tokens: %s", err)
+			}
+			last, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("malformed bucket time: %s", err)
+			}
+			elapsed := now.Sub(time.Unix(0, last)).Seconds()
+			tokens = math.Min(float64(l.Limit), saved+math.Max(elapsed, 0)*rate)
+		}
+		if tokens < 1 {
+			return time.Duration((1 - tokens) / rate * float64(time.Second)), nil
+		}
+
+		value = []byte(fmt.Sprintf("%f:%d", tokens-1, now.UnixNano()))
+		ok, err := store.CompareAndSwap(c, key, value, version, l.Window)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("too much contention in the bucket %s", key)
+}
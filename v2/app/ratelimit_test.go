@@ -0,0 +1,120 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"appengine"
+)
+
+func TestKeyByUser(t *testing.T) {
+	r := &Request{Req: httptest.NewRequest("GET", "/", nil)}
+	if key := KeyByUser(r); key != "ip:192.0.2.1" {
+		t.Errorf("anonymous key %q, expected the IP", key)
+	}
+
+	r.Session = sessions.NewSession(nil, "session")
+	r.Session.ID = "abc"
+	if key := KeyByUser(r); key != "session:abc" {
+		t.Errorf("anonymous key %q, expected the session", key)
+	}
+
+	r.SetUser("42")
+	if key := KeyByUser(r); key != "user:42" {
+		t.Errorf("key %q, expected the user", key)
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	a := newTestApp(map[string]Handler{
+		"::/login": With(okHandler, RateLimiter(&RateLimit{
+			Name:   "login",
+			Limit:  2,
+			Window: time.Hour,
+			Store:  NewMemoryCounterStore(),
+		})),
+	})
+
+	for i := 0; i < 2; i++ {
+		if rec := serveTest(a, "POST", "/login"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, expected 200", i, rec.Code)
+		}
+	}
+
+	rec := serveTest(a, "POST", "/login")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, expected 429", rec.Code)
+	}
+	retry, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || retry <= 0 || retry > 3600 {
+		t.Errorf("retry after %q, expected the rest of the window",
+			rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	l := &RateLimit{Algorithm: TokenBucket, Limit: 2, Window: 2 * time.Second}
+	store := NewMemoryCounterStore()
+	now := time.Now()
+
+	tests := []struct {
+		elapsed time.Duration
+		retry   time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{0, time.Second},
+		{500 * time.Millisecond, 500 * time.Millisecond},
+		{time.Second, 0},
+		{time.Second, time.Second},
+		{10 * time.Second, 0},
+		{10 * time.Second, 0},
+		{10 * time.Second, time.Second},
+	}
+	for i, test := range tests {
+		retry, err := l.allowTokenBucket(nil, store, "bucket", now.Add(test.elapsed))
+		if err != nil {
+			t.Fatalf("request %d: allow failed: %s", i, err)
+		}
+		if d := retry - test.retry; d < -time.Millisecond || d > time.Millisecond {
+			t.Errorf("request %d: retry after %s, expected %s", i, retry, test.retry)
+		}
+	}
+}
+
+// Fails the first swaps, as if other requests changed the bucket before.
+type contendedStore struct {
+	*MemoryCounterStore
+	conflicts int
+}
+
+func (s *contendedStore) CompareAndSwap(c appengine.Context, key string, value []byte, version interface{}, expiration time.Duration) (bool, error) {
+	if s.conflicts > 0 {
+		s.conflicts--
+		return false, nil
+	}
+	return s.MemoryCounterStore.CompareAndSwap(c, key, value, version, expiration)
+}
+
+func TestTokenBucketContention(t *testing.T) {
+	l := &RateLimit{Algorithm: TokenBucket, Limit: 1, Window: time.Minute}
+	now := time.Now()
+
+	store := &contendedStore{NewMemoryCounterStore(), 2}
+	if retry, err := l.allowTokenBucket(nil, store, "bucket", now); err != nil || retry != 0 {
+		t.Errorf("allow after retries: got %s, %v", retry, err)
+	}
+	if retry, _ := l.allowTokenBucket(nil, store, "bucket", now); retry == 0 {
+		t.Errorf("the token taken after the retries was not saved")
+	}
+
+	store = &contendedStore{NewMemoryCounterStore(), 5}
+	if _, err := l.allowTokenBucket(nil, store, "bucket", now); err == nil {
+		t.Errorf("expected an error when every swap fails")
+	}
+}
@@ -0,0 +1,260 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+// Severity of the reported errors.
+type Severity int
+
+const (
+	// Client errors (4xx status codes)
+	SeverityWarning Severity = iota
+
+	// Server errors
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Returns the severity of the errors with the status code.
+func codeSeverity(code int) Severity {
+	if code < 500 {
+		return SeverityWarning
+	}
+	return SeverityError
+}
+
+// ErrorReport is the first occurrence of an error or, if Digest is not nil,
+// a digest of the errors counted since the last one (see ErrorDigest).
+type ErrorReport struct {
+	Severity Severity  `json:"severity"`
+	Time     time.Time `json:"time"`
+
+	// First occurrence of an error
+	Error       string `json:"error,omitempty"`
+	Code        int    `json:"code,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	RequestID   string `json:"requestId,omitempty"`
+	Route       string `json:"route,omitempty"`
+	User        string `json:"user,omitempty"`
+
+	// Digest of errors, most frequent first
+	Since   time.Time           `json:"since,omitempty"`
+	Digest  []*ErrorDigestEntry `json:"digest,omitempty"`
+	Dropped int                 `json:"dropped,omitempty"`
+}
+
+// ErrorDigestEntry counts the occurrences of an error.
+type ErrorDigestEntry struct {
+	Fingerprint string    `json:"fingerprint"`
+	Message     string    `json:"message"`
+	Location    string    `json:"location"`
+	Severity    Severity  `json:"severity"`
+	Count       int       `json:"count"`
+	Routes      []string  `json:"routes"`
+	Requests    []string  `json:"requests"`
+	First       time.Time `json:"first"`
+	Last        time.Time `json:"last"`
+}
+
+// Formats the report for mails and logs.
+func (r *ErrorReport) String() string {
+	if r.Digest == nil {
+		return fmt.Sprintf("[request %s] %s", r.RequestID, r.Error)
+	}
+
+	total := r.Dropped
+	for _, entry := range r.Digest {
+		total += entry.Count
+	}
+	buf := []string{fmt.Sprintf("%d errors (%d different) since %s", total,
+		len(r.Digest), r.Since.UTC().Format(time.RFC1123))}
+	if r.Dropped > 0 {
+		buf = append(buf, fmt.Sprintf("%d errors of other kinds were not counted",
+			r.Dropped))
+	}
+	for _, entry := range r.Digest {
+		buf = append(buf, fmt.Sprintf("[%d times] %s\n"+
+			"  fingerprint: %s\n"+
+			"  location: %s\n"+
+			"  routes: %s\n"+
+			"  requests: %s\n"+
+			"  first: %s, last: %s",
+			entry.Count, entry.Message, entry.Fingerprint, entry.Location,
+			strings.Join(entry.Routes, ", "), strings.Join(entry.Requests, ", "),
+			entry.First.UTC().Format(time.RFC1123),
+			entry.Last.UTC().Format(time.RFC1123)))
+	}
+	return strings.Join(buf, "\n\n")
+}
+
+// Sorts the digest entries, most frequent first.
+func (r *ErrorReport) sortDigest() {
+	sort.Slice(r.Digest, func(i, j int) bool {
+		a, b := r.Digest[i], r.Digest[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Fingerprint < b.Fingerprint
+	})
+}
+
+// ErrorReporter sends the error reports to the admins.
+type ErrorReporter interface {
+	Report(c appengine.Context, report *ErrorReport) error
+}
+
+// Replaces the reporters of the app errors; the default one is
+// EmailReporter, filtered to SeverityError so the 4xx errors of bots and
+// scanners don't flood the mailbox. Call it with no reporters to disable
+// the reports.
+//
+//	a.SetErrorReporters(
+//	  app.EmailReporter{},
+//	  app.MinSeverity(app.SeverityError, &app.WebhookReporter{URL: hook}),
+//	)
+func (a *App) SetErrorReporters(reporters ...ErrorReporter) {
+	a.reporters = reporters
+}
+
+// Adds a reporter of the app errors.
+func (a *App) AddErrorReporter(reporter ErrorReporter) {
+	a.reporters = append(a.reporters, reporter)
+}
+
+// Sends the report to all the reporters, logging their failures.
+func (a *App) report(c appengine.Context, report *ErrorReport) {
+	for _, reporter := range a.reporters {
+		if err := reporter.Report(c, report); err != nil {
+			c.Errorf("[errors] report error failed: %s", err)
+		}
+	}
+}
+
+// Filters the reports sent to a reporter: only the errors with the min
+// severity or more are reported, and the digests lose their entries with less.
+func MinSeverity(min Severity, reporter ErrorReporter) ErrorReporter {
+	return &severityFilter{min, reporter}
+}
+
+type severityFilter struct {
+	min      Severity
+	reporter ErrorReporter
+}
+
+func (f *severityFilter) Report(c appengine.Context, report *ErrorReport) error {
+	if report.Digest == nil {
+		if report.Severity < f.min {
+			return nil
+		}
+		return f.reporter.Report(c, report)
+	}
+
+	filtered := *report
+	filtered.Digest = []*ErrorDigestEntry{}
+	for _, entry := range report.Digest {
+		if entry.Severity >= f.min {
+			filtered.Digest = append(filtered.Digest, entry)
+		}
+	}
+	if len(filtered.Digest) == 0 {
+		return nil
+	}
+	return f.reporter.Report(c, &filtered)
+}
+
+// EmailReporter enqueues the reports in the "admin-mails" queue, to be mailed
+// by the "/tasks/error-mail" handler of the app. The task receives the report
+// text in the Error value, and the RequestID, Fingerprint and Digest ones.
+// Nothing is mailed in the development server.
+type EmailReporter struct{}
+
+func (r EmailReporter) Report(c appengine.Context, report *ErrorReport) error {
+	digest := ""
+	if report.Digest != nil {
+		digest = "1"
+	}
+	return sendErrorByEmail(c, map[string]string{
+		"Error":       report.String(),
+		"RequestID":   report.RequestID,
+		"Fingerprint": report.Fingerprint,
+		"Digest":      digest,
+	})
+}
+
+// LogReporter writes the reports to the app logs only.
+type LogReporter struct{}
+
+func (r LogReporter) Report(c appengine.Context, report *ErrorReport) error {
+	if report.Severity == SeverityWarning {
+		c.Warningf("[errors] %s", report)
+	} else {
+		c.Errorf("[errors] %s", report)
+	}
+	return nil
+}
+
+// WebhookReporter posts the reports as JSON to an URL.
+type WebhookReporter struct {
+	URL string
+
+	// Additional headers of the requests, e.g. for the authentication
+	Header http.Header
+
+	// Returns the client to send the requests; by default the urlfetch one
+	// with a 10 seconds deadline.
+	Client func(c appengine.Context) *http.Client
+}
+
+func (r *WebhookReporter) Report(c appengine.Context, report *ErrorReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("marshal report failed: %s", err)
+	}
+
+	req, err := http.NewRequest("POST", r.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("prepare webhook request failed: %s", err)
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	var client *http.Client
+	if r.Client != nil {
+		client = r.Client(c)
+	} else {
+		client = &http.Client{
+			Transport: &urlfetch.Transport{
+				Context:  c,
+				Deadline: time.Duration(10) * time.Second,
+			},
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post webhook failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned status %d", r.URL, resp.StatusCode)
+	}
+	return nil
+}
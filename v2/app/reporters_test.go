@@ -0,0 +1,130 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/aetest"
+)
+
+func newTestWebhook(url string) *WebhookReporter {
+	return &WebhookReporter{
+		URL:    url,
+		Header: http.Header{"Authorization": {"Token secret"}},
+		Client: func(c appengine.Context) *http.Client {
+			return http.DefaultClient
+		},
+	}
+}
+
+func TestWebhookReporter(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("create context failed: %s", err)
+	}
+	defer c.Close()
+
+	var req *http.Request
+	got := &ErrorReport{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		if err := json.NewDecoder(r.Body).Decode(got); err != nil {
+			t.Errorf("decode report failed: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	report := &ErrorReport{
+		Severity:    SeverityError,
+		Time:        time.Date(2014, 3, 1, 10, 0, 0, 0, time.UTC),
+		Error:       "http error 500: datastore timeout",
+		Code:        500,
+		Fingerprint: "0123456789abcdef",
+		RequestID:   "req-1",
+		Route:       "/users/{id}",
+	}
+	if err := newTestWebhook(server.URL).Report(c, report); err != nil {
+		t.Fatalf("report failed: %s", err)
+	}
+
+	if req.Method != "POST" {
+		t.Errorf("method %s, expected POST", req.Method)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Token secret" {
+		t.Errorf("authorization header %q, expected the configured one", auth)
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("content type %q, expected json", ct)
+	}
+	if got.Severity != report.Severity || !got.Time.Equal(report.Time) ||
+		got.Error != report.Error || got.Code != report.Code ||
+		got.Fingerprint != report.Fingerprint || got.RequestID != report.RequestID ||
+		got.Route != report.Route {
+		t.Errorf("received report %+v, expected %+v", got, report)
+	}
+}
+
+func TestWebhookReporterStatusError(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("create context failed: %s", err)
+	}
+	defer c.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	report := &ErrorReport{Severity: SeverityError, Error: "failed"}
+	if err := newTestWebhook(server.URL).Report(c, report); err == nil {
+		t.Errorf("expected an error for the 503 status")
+	}
+}
+
+func TestMinSeverity(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("create context failed: %s", err)
+	}
+	defer c.Close()
+
+	received := []*ErrorReport{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := &ErrorReport{}
+		if err := json.NewDecoder(r.Body).Decode(report); err != nil {
+			t.Errorf("decode report failed: %s", err)
+		}
+		received = append(received, report)
+	}))
+	defer server.Close()
+
+	reporter := MinSeverity(SeverityError, newTestWebhook(server.URL))
+	reports := []*ErrorReport{
+		{Severity: SeverityWarning, Error: "not found"},
+		{Severity: SeverityError, Error: "failed"},
+		{Severity: SeverityError, Digest: []*ErrorDigestEntry{
+			{Fingerprint: "a", Severity: SeverityWarning, Count: 3},
+			{Fingerprint: "b", Severity: SeverityError, Count: 1},
+		}},
+	}
+	for _, report := range reports {
+		if err := reporter.Report(c, report); err != nil {
+			t.Fatalf("report failed: %s", err)
+		}
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("received %d reports, expected 2", len(received))
+	}
+	if received[0].Error != "failed" {
+		t.Errorf("warning report not filtered, received %q", received[0].Error)
+	}
+	if digest := received[1].Digest; len(digest) != 1 || digest[0].Fingerprint != "b" {
+		t.Errorf("digest warnings not filtered: %+v", digest)
+	}
+}
@@ -2,7 +2,9 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net/http"
 	"strings"
@@ -25,6 +27,21 @@ type Request struct {
 	C   appengine.Context
 	N   *goon.Goon
 	Session *sessions.Session
+
+	app       *App
+	rw        *responseWriter
+	route     *route
+	id        string
+	user      string
+
+	err          error
+	errCode      int
+	errorHandled bool
+	xsrfErr   error
+	corsCreds bool
+
+	securityPolicy *SecurityPolicy
+	cspNonce       string
 }
 
 // Load the request data using gorilla schema into a struct
@@ -71,6 +88,10 @@ func (r *Request) LoadJsonData(data interface{}) error {
 }
 
 func (r *Request) EmitJson(data interface{}) error {
+	if r.W.Header().Get("Content-Type") == "" {
+		r.W.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+
 	// XSSI protection
 	fmt.Fprintln(r.W, ")]}',")
 
@@ -113,41 +134,149 @@ func (r *Request) RedirectPermanently(path string) error {
 	return nil
 }
 
+// Builds the URL of a named route of the app. See App.URLFor.
+func (r *Request) URLFor(name string, pairs ...string) (string, error) {
+	return r.app.URLFor(name, pairs...)
+}
+
+// It returns the error of the URL generation, if any.
+// Example: return r.RedirectTo("feedback")
+func (r *Request) RedirectTo(name string, pairs ...string) error {
+	u, err := r.URLFor(name, pairs...)
+	if err != nil {
+		return err
+	}
+	return r.Redirect(u)
+}
+
+// Switches the response to streaming mode: the before commit hooks run and
+// the headers are sent right away, and the following writes go directly to
+// the client instead of being buffered until the handler returns. Use
+// r.Flush() to push the written data. The status code and the headers can't
+// be changed after this call.
+func (r *Request) Stream() error {
+	if r.rw.streaming {
+		return nil
+	}
+	if err := r.rw.stream(); err != nil {
+		return fmt.Errorf("stream response failed: %s", err)
+	}
+	return nil
+}
+
+// Registers a function that runs just before sending the status line and the
+// headers, so it can still change them. If the error is not nil the request
+// fails with it (unless the response is being streamed, where it's only
+// returned by Stream). If the hooks have run already, f is called right away
+// and its error returned.
+func (r *Request) BeforeCommit(f func() error) error {
+	return r.rw.beforeCommit(f)
+}
+
+// Sends the data written so far to the client when streaming.
+func (r *Request) Flush() {
+	r.rw.Flush()
+}
+
 func (r *Request) Template(names []string, data interface{}) error {
-	return Template(r.W, names, data)
+	return ExecTemplate(&TemplateConfig{
+		Names: names,
+		W:     r.W,
+		Data:  data,
+		Dir:   "templates",
+		Funcs: r.templateFuncs(),
+	})
+}
+
+// Template functions bound to this request.
+func (r *Request) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"url":      r.URLFor,
+		"cspNonce": r.CSPNonce,
+	}
 }
 
 func (r *Request) URL() string {
 	return r.Req.URL.String()
 }
 
+// Logs the error, with its call stack if it's an *Error, and reports it to
+// the admins (see ErrorDigest).
 func (r *Request) LogError(err error) {
-	r.C.Errorf("%v", err.Error())
-	if !strings.Contains(r.URL(), "/tasks/error-mail") && !appengine.IsDevAppServer() {
-		sendErrorByEmail(r.C, err.Error())
+	r.logError(err, callerLocation(1))
+}
+
+// Logs the error. The location identifies it if it has no stack.
+func (r *Request) logError(err error, location string) {
+	details := err.Error()
+	var e *Error
+	if errors.As(err, &e) {
+		details = fmt.Sprintf("%s\n\n%s", err, e.Stack())
+	}
+
+	r.C.Errorf("[request %s] %s", r.id, details)
+	if !strings.Contains(r.URL(), "/tasks/error-mail") {
+		r.reportError(err, details, location)
 	}
 }
 
+// Returns the error that triggered the error handler, or nil outside them.
+func (r *Request) Err() error {
+	return r.err
+}
+
+// Returns the status code of the error that triggered the error handler, or
+// zero outside them.
+func (r *Request) ErrCode() int {
+	return r.errCode
+}
+
 func (r *Request) processError(err error) {
-	code := 500
-	if e, ok := err.(HttpError); ok {
-		code = int(e)
-		r.LogError(fmt.Errorf("http status code %s", e))
-	} else {
-		r.LogError(err)
+	// Replace the partial output of the handler with the error one
+	r.rw.reset()
+	r.SetCachePolicy(NoStore)
+
+	code := ErrorCode(err)
+	if r.errorHandled {
+		// An error handler ran already (e.g. a before commit hook failed after
+		// it), don't run them again
+		r.LogError(fmt.Errorf("error after handling error %d: %s", r.errCode, err))
+		http.Error(r.W, "", code)
+		return
 	}
+	r.errorHandled = true
+	r.err = err
+	r.errCode = code
 
-	h, ok := errorHandlers[code]
+	r.logError(err, r.handlerLocation())
+
+	// API clients get a JSON body instead of the error handlers pages
+	if r.IsAPI() {
+		r.emitJsonError(code, err)
+		return
+	}
+
+	h, ok := r.app.errorHandlers[code]
+	if !ok {
+		h, ok = errorHandlers[code]
+	}
 	if ok {
-		if err := h(r); err == nil {
+		// The handler can change the status, the panics are recovered
+		r.W.WriteHeader(code)
+		handlerErr := Recovery(h)(r)
+		if handlerErr == nil {
 			return
 		}
+		r.LogError(fmt.Errorf("error handler %d failed: %s", code, handlerErr))
+		r.rw.reset()
 	}
 
 	http.Error(r.W, "", code)
 }
 
-// Sets a new handler function for HTTP errors that returns the code status
+// Sets a new handler function for HTTP errors that returns the code status.
+// The handler gets the error with r.Err(); if it fails the plain status is
+// sent instead.
 func SetErrorHandler(code int, f Handler) {
 	errorHandlers[code] = f
 }
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// Buffers the response of the handlers. Nothing is sent to the client until
+// the response is committed: first the before commit hooks run (saving the
+// session, setting cookies & headers, ...), then the status line and the
+// headers are sent and finally the buffered body.
+type responseWriter struct {
+	w    http.ResponseWriter
+	buf  *bytes.Buffer
+	code int
+	size int64
+
+	hooks                          []func() error
+	prepared, committed, streaming bool
+	noCompression, etag            bool
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{w: w, buf: bytes.NewBuffer(nil)}
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	if w.streaming {
+		n, err := w.w.Write(data)
+		w.size += int64(n)
+		return n, err
+	}
+	return w.buf.Write(data)
+}
+
+// Saves the status code until the response is committed. It's ignored if the
+// response has been committed already.
+func (w *responseWriter) WriteHeader(code int) {
+	if w.committed {
+		return
+	}
+	w.code = code
+}
+
+// Sends the buffered data to the client if the response is being streamed.
+func (w *responseWriter) Flush() {
+	if !w.streaming {
+		return
+	}
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Registers a function to run before committing the response. If the hooks
+// have run already it's called right away.
+func (w *responseWriter) beforeCommit(f func() error) error {
+	if w.prepared {
+		return f()
+	}
+	w.hooks = append(w.hooks, f)
+	return nil
+}
+
+// Runs the before commit hooks once. It returns the first error, but all the
+// hooks are run anyway.
+func (w *responseWriter) prepare() error {
+	if w.prepared {
+		return nil
+	}
+	w.prepared = true
+
+	var first error
+	for _, f := range w.hooks {
+		if err := f(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Sends the status line & the headers to the client.
+func (w *responseWriter) commit() {
+	if w.committed {
+		return
+	}
+	w.committed = true
+	if w.code != 0 {
+		w.w.WriteHeader(w.code)
+	}
+}
+
+// Discards the buffered body if it has not been sent yet.
+func (w *responseWriter) reset() {
+	if !w.committed {
+		w.buf.Reset()
+	}
+}
+
+// Stops buffering: the response is committed, the data already written is
+// sent and the next writes go directly to the client.
+func (w *responseWriter) stream() error {
+	hooksErr := w.prepare()
+	w.streaming = true
+	if err := w.output(); err != nil {
+		return err
+	}
+	return hooksErr
+}
+
+func (w *responseWriter) output() error {
+	w.commit()
+	n, err := io.Copy(w.w, w.buf)
+	w.size += n
+	return err
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"appengine/aetest"
+)
+
+// Builds a request of a minimal app, with a before commit hook that sets the
+// session cookie like the Sessions middleware.
+func newTestRequest(t *testing.T, method string) (*Request, *httptest.ResponseRecorder, func()) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("create context failed: %s", err)
+	}
+
+	a := &App{
+		errorHandlers: map[int]Handler{},
+		cachePolicy:   NoStore,
+		errorStore:    NewMemoryCounterStore(),
+	}
+	rec := httptest.NewRecorder()
+	rw := newResponseWriter(rec)
+	r := &Request{
+		Req: httptest.NewRequest(method, "/test", nil),
+		W:   rw,
+		C:   c,
+		app: a,
+		rw:  rw,
+		id:  "test",
+	}
+	r.BeforeCommit(func() error {
+		http.SetCookie(r.W, &http.Cookie{Name: "session", Value: "saved"})
+		return nil
+	})
+	return r, rec, func() { c.Close() }
+}
+
+func checkSessionCookie(t *testing.T, rec *httptest.ResponseRecorder) {
+	if cookie := rec.Header().Get("Set-Cookie"); cookie != "session=saved" {
+		t.Errorf("session cookie not saved before the commit: %q", cookie)
+	}
+}
+
+func TestRedirectRunsHooks(t *testing.T) {
+	r, rec, done := newTestRequest(t, "GET")
+	defer done()
+
+	r.app.serve(r, func(r *Request) error {
+		return r.Redirect("/login")
+	})
+
+	if rec.Code != http.StatusFound {
+		t.Errorf("status %d, expected %d", rec.Code, http.StatusFound)
+	}
+	if location := rec.Header().Get("Location"); location != "/login" {
+		t.Errorf("location %q, expected /login", location)
+	}
+	checkSessionCookie(t, rec)
+}
+
+func TestExplicitStatusRunsHooks(t *testing.T) {
+	r, rec, done := newTestRequest(t, "POST")
+	defer done()
+
+	r.app.serve(r, func(r *Request) error {
+		r.W.WriteHeader(http.StatusCreated)
+		_, err := r.W.Write([]byte("created"))
+		return err
+	})
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("status %d, expected %d", rec.Code, http.StatusCreated)
+	}
+	if body := rec.Body.String(); body != "created" {
+		t.Errorf("body %q, expected created", body)
+	}
+	checkSessionCookie(t, rec)
+}
+
+func TestErrorRunsHooksAndDropsPartialBody(t *testing.T) {
+	r, rec, done := newTestRequest(t, "GET")
+	defer done()
+
+	r.app.serve(r, func(r *Request) error {
+		r.W.Write([]byte("partial output"))
+		return errors.New("handler failed")
+	})
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, expected %d", rec.Code, http.StatusInternalServerError)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "partial") {
+		t.Errorf("partial body sent with the error: %q", body)
+	}
+	checkSessionCookie(t, rec)
+}
+
+func TestErrorHandlerStatus(t *testing.T) {
+	r, rec, done := newTestRequest(t, "GET")
+	defer done()
+
+	r.app.errorHandlers[404] = func(r *Request) error {
+		_, err := r.W.Write([]byte("not found page"))
+		return err
+	}
+	r.app.serve(r, func(r *Request) error {
+		r.W.Write([]byte("partial output"))
+		return NotFound("missing")
+	})
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, expected %d", rec.Code, http.StatusNotFound)
+	}
+	if body := rec.Body.String(); body != "not found page" {
+		t.Errorf("body %q, expected the error handler one", body)
+	}
+	checkSessionCookie(t, rec)
+}
+
+func TestResetDropsPartialBody(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := newResponseWriter(rec)
+	w.Write([]byte("partial"))
+	w.WriteHeader(http.StatusAccepted)
+	w.reset()
+	w.Write([]byte("final"))
+	if err := w.output(); err != nil {
+		t.Fatalf("output failed: %s", err)
+	}
+
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("status %d, expected %d", rec.Code, http.StatusAccepted)
+	}
+	if body := rec.Body.String(); body != "final" {
+		t.Errorf("body %q, expected final", body)
+	}
+}
+
+func TestResetAfterCommitKeepsBody(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := newResponseWriter(rec)
+	w.Write([]byte("sent"))
+	if err := w.output(); err != nil {
+		t.Fatalf("output failed: %s", err)
+	}
+	w.reset()
+	w.WriteHeader(http.StatusInternalServerError)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "sent" {
+		t.Errorf("committed response changed: %d %q", rec.Code, rec.Body.String())
+	}
+}
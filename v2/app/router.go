@@ -5,227 +5,320 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"io"
-	"bytes"
+	"time"
 
 	"conf"
-	"server/model"
 
 	"appengine"
 
 	"github.com/gorilla/mux"
-	gaesessions "code.google.com/p/sadbox/appengine/sessions"
-	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/mjibson/appstats"
 	"github.com/mjibson/goon"
 )
 
-var (
-	dStore = gaesessions.NewDatastoreStore(model.KindSession,
-			[]byte(conf.SessionSecret))
-	xsrfCodecs = securecookie.CodecsFromPairs([]byte(conf.XSRFSecret))
-)
-
 type Handler func(r *Request) error
 
-// Build the router table at init().
+// App is a self-contained router table with its own error handlers. It
+// implements http.Handler, so it can be mounted anywhere (under a prefix with
+// http.StripPrefix, in a httptest server, ...) and created as many times as
+// needed in the same binary.
+type App struct {
+	router        *mux.Router
+	errorHandlers map[int]Handler
+	middlewares   []Middleware
+	routes        []*route
+	compression   *CompressionConfig
+	cachePolicy   *CachePolicy
+	security      *SecurityPolicy
+	sessionStore  sessions.Store
+	sessionOpts   *SessionOptions
+	bearerAuth    BearerAuth
+	cors          *CORSPolicy
+	accessLogger  AccessLogger
+	errorStore    CounterStore
+	reporters     []ErrorReporter
+}
+
+// Build a new application from a routes map.
 //
 // Example routes map:
 //    map[string]app.Handler{
 //      "ERROR::404": stuff.NotFound,
 //      "DELETE::/_/example": example.Delete,
 //      ....
-//      "::/_/feedback": stuff.Feedback,
+//      "::/_/feedback::feedback": stuff.Feedback,
 //    }
 //
-func Router(routes map[string]Handler) {
-	r := mux.NewRouter().StrictSlash(true)
-	r.NotFoundHandler = appstatsWrapper(func(r *Request) error {
-		return NotFound()
-	})
-	http.Handle("/", r)
-
-	for route, handler := range routes {
-		h := appstatsWrapper(handler)
-		parts := strings.Split(route, "::")
-		if len(parts) != 2 {
-			panic("route not in the method::path format")
+// The optional third part of the key names the route, so its URL can be
+// built with Request.URLFor or the "url" template function.
+//
+// Routes are registered in a deterministic order, comparing their paths
+// segment by segment: static segments go before variable ones ("/users/new"
+// before "/users/{id}"), variables with a pattern before the ones without it
+// and then alphabetically; longer paths go before their own prefixes. Group
+// routes are registered after the ones of their parent. It panics if two
+// routes have the same path (ignoring the variable names) and overlapping
+// methods; a route that can lose requests to one registered before it (a
+// variable before a static segment or two different variables) is logged.
+//
+// GET routes answer HEAD requests too. Requests whose path matches some route
+// but not its method get a 405 error (see "ERROR::405") with the Allow header,
+// and OPTIONS requests are answered from the routes table.
+//
+func NewApp(routes map[string]Handler) *App {
+	a := &App{
+		router:        mux.NewRouter().StrictSlash(true),
+		errorHandlers: map[int]Handler{},
+		middlewares:   DefaultMiddlewares(),
+		compression:   DefaultCompression,
+		cachePolicy:   NoStore,
+		security:      DefaultSecurity,
+		sessionStore:  defaultSessionStore(),
+		sessionOpts:   DefaultSessionOptions,
+		accessLogger:  DefaultAccessLogger,
+		errorStore:    MemcacheCounterStore{},
+		reporters:     []ErrorReporter{MinSeverity(SeverityError, EmailReporter{})},
+	}
+	// Newer mux versions send the method mismatches to their own handler
+	notMatched := a.wrap(a.notMatched, nil)
+	a.router.NotFoundHandler = notMatched
+	a.router.MethodNotAllowedHandler = notMatched
+
+	a.handle(a.router, nil, routes)
+
+	return a
+}
+
+// Registers the routes map in the router, decorating every handler with the
+// middlewares of its group (nil for the NewApp routes). Group routes are
+// registered in their subrouter after the routes of NewApp, in the order the
+// groups are created.
+func (a *App) handle(router *mux.Router, g *Group, routes map[string]Handler) {
+	prefix := ""
+	var mws []Middleware
+	if g != nil {
+		prefix, mws = g.prefix, g.middlewares
+	}
+
+	entries, errors := parseRoutes(prefix, routes)
+	for code, handler := range errors {
+		if g != nil {
+			panic(fmt.Sprintf("ERROR::%d entry in group %s: the error handlers "+
+				"are global, set them in NewApp", code, g.prefix))
 		}
+		a.SetErrorHandler(code, handler)
+	}
+
+	for _, entry := range entries {
+		checkRouteConflicts(a.routes, entry)
+		a.routes = append(a.routes, entry)
+		entry.group = g
 
-		// Error handlers
-		if parts[0] == "ERROR" {
-			n, err := strconv.ParseInt(parts[1], 10, 64)
-			if err != nil {
-				panic(err)
+		r := router.Handle(strings.TrimPrefix(entry.path, prefix),
+			a.wrap(With(entry.handler, mws...), entry))
+		if entry.name != "" {
+			if a.router.Get(entry.name) != nil {
+				panic("duplicated route name: " + entry.name)
 			}
-			SetErrorHandler(int(n), handler)
-			continue
-		} 
-
-		// Generalist handlers (no method specified)
-		if len(parts[0]) == 0 {
-			r.Handle(parts[1], h)
-			continue
+			r.Name(entry.name)
 		}
 
-		// Handlers for a concrete method
-		r.Handle(parts[1], h).Methods(parts[0])
+		// Handlers for a concrete method (generalist ones have no method)
+		if entry.methods != nil {
+			r.Methods(entry.methods...)
+		}
 	}
 }
 
-type responseWriter struct {
-	w http.ResponseWriter
-	buf *bytes.Buffer
+// Handles the requests that don't match any route. If the path matches but
+// the method doesn't it returns a 405 error with the Allow header, and answers
+// the OPTIONS requests directly.
+func (a *App) notMatched(r *Request) error {
+	allowed := allowedMethods(a.routes, r.Req)
+	if allowed == nil {
+		// Keep the path out of the message, every scanned URL would get its
+		// own fingerprint otherwise; the report has it in its route.
+		return NotFound("no route matches the request")
+	}
+
+	r.W.Header().Set("Allow", strings.Join(allowed, ", "))
+	if r.Req.Method == "OPTIONS" {
+		return nil
+	}
+	return NotAllowed("method not allowed by the matching routes")
 }
 
-func newResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{w: w, buf: bytes.NewBuffer(nil)}
+func (a *App) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.router.ServeHTTP(w, req)
 }
 
-func (w *responseWriter) Header() http.Header {
-	return w.w.Header()
+// Sets a new handler function for HTTP errors of this app only. It takes
+// precedence over the ones registered with the global SetErrorHandler.
+func (a *App) SetErrorHandler(code int, f Handler) {
+	a.errorHandlers[code] = f
 }
 
-func (w *responseWriter) Write(data []byte) (int, error) {
-	return w.buf.Write(data)
+// Builds the URL of a named route, replacing the path variables with the
+// key/value pairs:
+//    a.URLFor("user", "id", "42")
+func (a *App) URLFor(name string, pairs ...string) (string, error) {
+	route := a.router.Get(name)
+	if route == nil {
+		return "", fmt.Errorf("route %s not found", name)
+	}
+
+	u, err := route.URL(pairs...)
+	if err != nil {
+		return "", fmt.Errorf("build url of route %s failed: %s", name, err)
+	}
+	return u.String(), nil
 }
 
-func (w *responseWriter) WriteHeader(code int) {
-	w.w.WriteHeader(code)
+// Appends global middlewares to the chain that runs before every handler of
+// the app. The chain starts with DefaultMiddlewares().
+func (a *App) Use(mws ...Middleware) {
+	a.middlewares = append(a.middlewares, mws...)
 }
 
-func (w *responseWriter) output() error {
-	_, err := io.Copy(w.w, w.buf)
-	return err
+// Replaces the whole global middlewares chain, including the default ones.
+// Use it to reorder or remove the built-in behaviours:
+//    a.SetMiddlewares(app.Recovery, app.Sessions, auth.Check, app.XSRF)
+func (a *App) SetMiddlewares(mws ...Middleware) {
+	a.middlewares = mws
 }
 
-func appstatsWrapper(h Handler) http.Handler {
-	f := func(c appengine.Context, w http.ResponseWriter, req *http.Request) {
-		// Emit some compatibility & anti-cache headers for IE (you can overwrite
-		// them from the handlers if needed)
-		w.Header().Set("X-UA-Compatible", "chrome=1")
-		w.Header().Set("Cache-Control", "max-age=0,no-cache,no-store,"+
-			"post-check=0,pre-check=0")
-		w.Header().Set("Expires", "Mon, 26 Jul 1997 05:00:00 GMT")
-
-		// Build the request & session objects
-		rw := newResponseWriter(w)
-		r := &Request{Req: req, W: rw, C: c, N: goon.FromContext(c)}
-		session, token, err := getSession(req, rw)
-		if err != nil {
-			r.processError(fmt.Errorf("build session failed: %s", err))
-			return
-		}
-		r.Session = session
-
-		// Check XSRF token
-		if req.Method != "GET" {
-			if ok, err := checkXsrfToken(req, token); err != nil {
-				r.processError(fmt.Errorf("check xsrf token failed: %s", err))
-				return
-			} else if !ok {
-				c.Errorf("xsrf token header check failed")
-				r.processError(Forbidden())
-				return
-			}
-		}
+// Changes the compression settings of the buffered responses. A nil config
+// disables the compression.
+func (a *App) SetCompression(c *CompressionConfig) {
+	a.compression = c
+}
 
-		// Fatal errors recovery
-		defer func() {
-			if rec := recover(); rec != nil {
-				err := fmt.Errorf("panic recovered error: %s", rec)
-				r.processError(err)
-			}
-		}()
+// Changes the cache policy of the responses whose routes or handlers don't
+// set their own one.
+func (a *App) SetCachePolicy(p *CachePolicy) {
+	a.cachePolicy = p
+}
 
-		// Handle the request
-		if err := h(r); err != nil {
-			r.processError(err)
-		}
+// Changes the security policy of the responses whose routes or handlers don't
+// set their own one.
+func (a *App) SetSecurityPolicy(p *SecurityPolicy) {
+	a.security = p
+}
 
-		// Save the session & copy the buffered output
-		if err := sessions.Save(req, w); err != nil {
-			r.processError(err)
-		}
-		if err := rw.output(); err != nil {
-			r.processError(err)
+// Changes the function that records the access log of the requests. A nil
+// logger disables it.
+func (a *App) SetAccessLogger(l AccessLogger) {
+	a.accessLogger = l
+}
+
+// Changes the store where the sessions are saved. See NewDatastoreStore,
+// NewCookieStore and NewMemoryStore.
+func (a *App) SetSessionStore(store sessions.Store) {
+	a.sessionStore = store
+}
+
+// Exempts the named routes from the XSRF check, for example the ones called
+// by webhooks. It panics if a route doesn't exist.
+func (a *App) ExemptXSRF(names ...string) {
+	for _, name := range names {
+		for _, entry := range a.routesNamed(name) {
+			entry.xsrfExempt = true
 		}
 	}
-	return appstats.NewHandler(f)
 }
 
-// Return the session, the old XSRF token and an error if needed
-func getSession(req *http.Request, w http.ResponseWriter) (*sessions.Session, []uint8, error) {
-	session, _ := dStore.Get(req, conf.SessionName)
-	session.Options = &sessions.Options{
-		Path: "/",
-		MaxAge: 7 * 24 * 60 * 60, // 7 days
-	}
+// Enables the bearer tokens: f validates the token of every request with an
+// "Authorization: Bearer" header, whatever its method, and the accepted ones
+// skip the XSRF check. See BearerAuth.
+func (a *App) SetBearerAuth(f BearerAuth) {
+	a.bearerAuth = f
+}
 
-	var oldtoken []uint8
-	if session.Values["xsrf"] != nil {
-		oldtoken = session.Values["xsrf"].([]uint8)
-	}
-	token := securecookie.GenerateRandomKey(32)
-	session.Values["xsrf"] = token
+// Enables the cross-origin requests to the routes of the app that don't
+// belong to a group with its own policy. A nil policy disables them.
+func (a *App) SetCORS(p *CORSPolicy) {
+	a.cors = p
+}
 
-	encoded, err := securecookie.EncodeMulti("XSRF-TOKEN", token, xsrfCodecs...)
-	if err != nil {
-		return nil, nil, fmt.Errorf("encode token failed: %s", err)
-	}
-	http.SetCookie(w, &http.Cookie{
-		Name: "XSRF-TOKEN",
-		Value: encoded,
-		Path: "/",
-	})
-	return session, oldtoken, nil
+// Changes the options of the session cookie and its expiration.
+func (a *App) SetSessionOptions(opts *SessionOptions) {
+	a.sessionOpts = opts
 }
 
-// Returns true if the XSRF token was correct and an error if needed
-func checkXsrfToken(req *http.Request, token []uint8) (bool, error) {
-	c := appengine.NewContext(req)
+// Build the router table at init() and serve it from the root of
+// http.DefaultServeMux. See NewApp for the routes map format.
+//
+// The sessions are saved with the DefaultSessionKind datastore kind. Apps
+// upgrading from an older version must set it to their model.KindSession
+// first, or the existing sessions are lost:
+//    app.DefaultSessionKind = model.KindSession
+//    app.Router(routes)
+func Router(routes map[string]Handler) {
+	http.Handle("/", NewApp(routes))
+}
+
+// Returns the http.Handler of a route (nil for the not matched requests).
+func (a *App) wrap(h Handler, entry *route) http.Handler {
+	f := func(c appengine.Context, w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rw := newResponseWriter(w)
+		r := &Request{Req: req, W: rw, C: c, N: goon.FromContext(c), app: a, rw: rw,
+			route: entry, id: requestID(c, req)}
+		w.Header().Set(RequestIDHeader, r.id)
+		defer r.logAccess(start)
 
-	if token == nil {
-		c.Errorf("[xsrf] token is nil")
-		return false, nil
+		a.serve(r, h)
 	}
+	return appstats.NewHandler(f)
+}
 
-	var cookie string
-	for _, c := range req.Cookies() {
-		if c.Name == "XSRF-TOKEN" {
-			cookie = c.Value
+// Runs the handler and sends its buffered response.
+func (a *App) serve(r *Request, h Handler) {
+	rw := r.rw
+	r.SetCachePolicy(a.cachePolicy)
+	r.SetSecurityPolicy(a.security)
+	rw.beforeCommit(r.writeSecurityHeaders)
+
+	// Handle the request through the middlewares chain, unless it's a
+	// CORS preflight one
+	if !r.handleCORS() {
+		if err := With(h, a.middlewares...)(r); err != nil {
+			r.processError(err)
 		}
 	}
-	if cookie == "" {
-		c.Errorf("[xsrf] no cookie")
-		return false, nil
-	}
 
-	// Inconsistencies between the script & the cookies
-	header := req.Header.Get("X-Xsrf-Token")
-	if header != cookie {
-		c.Errorf("[xsrf] inconsistency between the header & cookie: %s != %s",
-			header, cookie)
-		return false, nil
+	// Run the before commit hooks while the status can still change
+	if err := rw.prepare(); err != nil {
+		r.processError(err)
 	}
 
-	// Check the token itself
-	var unsafeToken []uint8
-	err := securecookie.DecodeMulti("XSRF-TOKEN", header, &unsafeToken, xsrfCodecs...)
-	if err != nil {
-		return false, fmt.Errorf("decode failed: %s", err)
-	}
-	if len(token) != len(unsafeToken) {
-		c.Errorf("[xsrf] length check failed: %d != %d", len(token), len(unsafeToken))
-		return false, nil
+	// Compress the body and check the conditional GET headers
+	if err := rw.compress(r.Req, a.compression); err != nil {
+		r.LogError(err)
 	}
-	for i := range token {
-		if token[i] != unsafeToken[i] {
-			c.Errorf("[xsrf] character %d is not equal", i)
-			return false, nil
+	rw.conditional(r.Req)
+
+	// Copy the buffered output (HEAD responses have no body). Streamed
+	// responses sent their headers already and have nothing buffered.
+	if r.Req.Method == "HEAD" {
+		if rw.code != http.StatusNotModified && !rw.streaming {
+			rw.Header().Set("Content-Length", strconv.Itoa(rw.buf.Len()))
 		}
+		rw.commit()
+		return
+	}
+	if err := rw.output(); err != nil {
+		r.LogError(fmt.Errorf("write output failed: %s", err))
 	}
+}
 
-	return true, nil
+// Returns the session of the request, expired if needed
+func getSession(store sessions.Store, opts *SessionOptions, req *http.Request) (*sessions.Session, error) {
+	session, err := store.Get(req, conf.SessionName)
+	if session == nil {
+		return nil, err
+	}
+	opts.apply(session)
+	return session, nil
 }
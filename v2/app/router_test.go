@@ -0,0 +1,127 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"appengine"
+)
+
+// Builds an app without the default middlewares nor reporters, counting the
+// errors in memory.
+func newTestApp(routes map[string]Handler) *App {
+	a := NewApp(routes)
+	a.SetMiddlewares()
+	a.SetErrorStore(NewMemoryCounterStore())
+	a.SetErrorReporters()
+	a.SetAccessLogger(nil)
+	return a
+}
+
+func okHandler(r *Request) error {
+	_, err := r.W.Write([]byte("ok"))
+	return err
+}
+
+func serveTest(a *App, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	handled := false
+	a := newTestApp(map[string]Handler{
+		"POST::/x":   okHandler,
+		"DELETE::/x": okHandler,
+		"ERROR::405": func(r *Request) error {
+			handled = true
+			return nil
+		},
+	})
+
+	rec := serveTest(a, "GET", "/x")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status %d, expected 405", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "DELETE, OPTIONS, POST" {
+		t.Errorf("allow header %q, expected DELETE, OPTIONS, POST", allow)
+	}
+	if !handled {
+		t.Errorf("the ERROR::405 handler didn't run")
+	}
+}
+
+func TestOptionsAnswered(t *testing.T) {
+	a := newTestApp(map[string]Handler{
+		"POST::/x": okHandler,
+	})
+
+	rec := serveTest(a, "OPTIONS", "/x")
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, expected 200", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "OPTIONS, POST" {
+		t.Errorf("allow header %q, expected OPTIONS, POST", allow)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	a := newTestApp(map[string]Handler{
+		"POST::/x": okHandler,
+	})
+
+	rec := serveTest(a, "GET", "/y")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, expected 404", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "" {
+		t.Errorf("allow header %q in a 404", allow)
+	}
+}
+
+type recordingReporter struct {
+	reports []*ErrorReport
+}
+
+func (r *recordingReporter) Report(c appengine.Context, report *ErrorReport) error {
+	r.reports = append(r.reports, report)
+	return nil
+}
+
+func TestNotMatchedFingerprint(t *testing.T) {
+	a := newTestApp(map[string]Handler{
+		"POST::/x": okHandler,
+	})
+	reporter := &recordingReporter{}
+	a.SetErrorReporters(reporter)
+
+	serveTest(a, "GET", "/wp-login.php")
+	serveTest(a, "GET", "/.env")
+	if len(reporter.reports) != 1 {
+		t.Fatalf("got %d reports of unmatched paths, expected 1", len(reporter.reports))
+	}
+	if route := reporter.reports[0].Route; route != "/wp-login.php" {
+		t.Errorf("report route %q, expected the path", route)
+	}
+}
+
+func TestHeadLength(t *testing.T) {
+	a := newTestApp(map[string]Handler{
+		"GET::/buffered": okHandler,
+		"GET::/streamed": func(r *Request) error {
+			if err := r.Stream(); err != nil {
+				return err
+			}
+			return okHandler(r)
+		},
+	})
+
+	if length := serveTest(a, "HEAD", "/buffered").Header().Get("Content-Length"); length != "2" {
+		t.Errorf("buffered content length %q, expected 2", length)
+	}
+	if length := serveTest(a, "HEAD", "/streamed").Header().Get("Content-Length"); length != "" {
+		t.Errorf("streamed content length %q, expected none", length)
+	}
+}
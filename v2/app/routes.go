@@ -0,0 +1,291 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// A parsed entry of a routes map.
+type route struct {
+	key     string
+	method  string // empty for generalist routes
+	path    string // full path, including the group prefixes
+	name    string
+	handler Handler
+
+	// Methods accepted by the route, nil for all of them. GET routes serve
+	// HEAD too unless there is an explicit HEAD route with the same path.
+	methods []string
+
+	// Matches the path only, to build the Allow header
+	matcher *mux.Route
+
+	group      *Group
+	xsrfExempt bool
+	api        bool
+}
+
+// Returns true if the route or any of its groups is exempted from the XSRF
+// check.
+func (r *route) exemptFromXSRF() bool {
+	return r.xsrfExempt || r.anyGroup(func(g *Group) bool { return g.xsrfExempt })
+}
+
+// Returns true if the route or any of its groups is an API one.
+func (r *route) isAPI() bool {
+	return r.api || r.anyGroup(func(g *Group) bool { return g.api })
+}
+
+// Returns true if f is true for any of the groups of the route, from the
+// innermost one.
+func (r *route) anyGroup(f func(g *Group) bool) bool {
+	for g := r.group; g != nil; g = g.parent {
+		if f(g) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the routes of the app with the name. It panics if there is none.
+func (a *App) routesNamed(name string) []*route {
+	found := []*route{}
+	for _, entry := range a.routes {
+		if entry.name == name {
+			found = append(found, entry)
+		}
+	}
+	if len(found) == 0 {
+		panic("route not found: " + name)
+	}
+	return found
+}
+
+// Parses the routes map entries and returns them in registration order (see
+// NewApp). The ERROR entries are returned apart, indexed by status code.
+func parseRoutes(prefix string, routes map[string]Handler) ([]*route, map[int]Handler) {
+	entries := []*route{}
+	errors := map[int]Handler{}
+	for key, handler := range routes {
+		parts := strings.Split(key, "::")
+		if len(parts) != 2 && len(parts) != 3 {
+			panic("route not in the method::path[::name] format: " + key)
+		}
+
+		// Error handlers
+		if parts[0] == "ERROR" {
+			if len(parts) == 3 {
+				panic("error handlers cannot be named: " + key)
+			}
+			n, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				panic(err)
+			}
+			errors[int(n)] = handler
+			continue
+		}
+
+		r := &route{
+			key:     key,
+			method:  parts[0],
+			path:    prefix + parts[1],
+			handler: handler,
+		}
+		if len(parts) == 3 {
+			r.name = parts[2]
+		}
+		entries = append(entries, r)
+	}
+
+	sort.Sort(routesOrder(entries))
+
+	heads := map[string]bool{}
+	for _, r := range entries {
+		if r.method == "HEAD" {
+			heads[pathShape(r.path)] = true
+		}
+	}
+	for _, r := range entries {
+		if r.method == "GET" && !heads[pathShape(r.path)] {
+			r.methods = []string{"GET", "HEAD"}
+		} else if r.method != "" {
+			r.methods = []string{r.method}
+		}
+		r.matcher = mux.NewRouter().NewRoute().Path(r.path)
+	}
+
+	return entries, errors
+}
+
+type routesOrder []*route
+
+func (o routesOrder) Len() int      { return len(o) }
+func (o routesOrder) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+
+func (o routesOrder) Less(i, j int) bool {
+	a, b := pathSegments(o[i].path), pathSegments(o[j].path)
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] == b[k] {
+			continue
+		}
+		if isVariable(a[k]) != isVariable(b[k]) {
+			return !isVariable(a[k])
+		}
+		if isVariable(a[k]) && hasPattern(a[k]) != hasPattern(b[k]) {
+			return hasPattern(a[k])
+		}
+		return a[k] < b[k]
+	}
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+
+	return o[i].key < o[j].key
+}
+
+// Checks the new route against the already registered ones, in the order
+// mux tries them (group routes go after the routes of their parent). It
+// panics if both can match the same requests no matter the order (same path
+// shape and overlapping methods), and logs a warning if a registered route
+// can take some of the requests of the new one.
+func checkRouteConflicts(registered []*route, r *route) {
+	for _, warning := range routeConflicts(registered, r) {
+		log.Printf("[router] %s", warning)
+	}
+}
+
+func routeConflicts(registered []*route, r *route) []string {
+	warnings := []string{}
+	for _, other := range registered {
+		if !methodsOverlap(r.methods, other.methods) {
+			continue
+		}
+
+		if pathShape(r.path) == pathShape(other.path) {
+			panic(fmt.Sprintf("route %s (%s) conflicts with route %s (%s)",
+				r.key, r.path, other.key, other.path))
+		}
+
+		if pathsOverlap(r.path, other.path) && !moreSpecific(other.path, r.path) {
+			warnings = append(warnings, fmt.Sprintf(
+				"route %s (%s) can be shadowed by route %s (%s), registered before it",
+				r.key, r.path, other.key, other.path))
+		}
+	}
+	return warnings
+}
+
+func methodsOverlap(a, b []string) bool {
+	if a == nil || b == nil {
+		return true
+	}
+	for _, m := range a {
+		for _, other := range b {
+			if m == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the routes whose path matches the request, no matter the method.
+func matchingRoutes(routes []*route, req *http.Request) []*route {
+	matching := []*route{}
+	for _, r := range routes {
+		var match mux.RouteMatch
+		if r.matcher.Match(req, &match) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+// Returns the methods accepted by the method specific routes whose path
+// matches the request, sorted and including OPTIONS. It returns nil if no
+// path matches.
+func allowedMethods(routes []*route, req *http.Request) []string {
+	found := map[string]bool{}
+	for _, r := range matchingRoutes(routes, req) {
+		for _, m := range r.methods {
+			found[m] = true
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+
+	found["OPTIONS"] = true
+	methods := make([]string, 0, len(found))
+	for m := range found {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func pathSegments(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+func isVariable(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// Returns the path with the variable names removed, keeping their patterns:
+// "/users/{id:[0-9]+}" becomes "/users/{[0-9]+}".
+func pathShape(path string) string {
+	segments := pathSegments(path)
+	for i, s := range segments {
+		if isVariable(s) {
+			if idx := strings.Index(s, ":"); idx != -1 {
+				segments[i] = "{" + s[idx+1:]
+			} else {
+				segments[i] = "{}"
+			}
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// Returns true if some URL could match both paths. Variables are supposed
+// to match any segment.
+func pathsOverlap(a, b string) bool {
+	as, bs := pathSegments(a), pathSegments(b)
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if as[i] != bs[i] && !isVariable(as[i]) && !isVariable(bs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if every segment of a is equal to the one of b (ignoring the
+// variable names) or is static where b has a variable. Such routes can be
+// registered before b without shadowing it completely. Two different
+// variables are never more specific than each other.
+func moreSpecific(a, b string) bool {
+	as, bs := pathSegments(pathShape(a)), pathSegments(pathShape(b))
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if as[i] != bs[i] && (isVariable(as[i]) || !isVariable(bs[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasPattern(segment string) bool {
+	return strings.Contains(segment, ":")
+}
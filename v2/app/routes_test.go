@@ -0,0 +1,148 @@
+package app
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func routePaths(routes []*route) []string {
+	paths := []string{}
+	for _, r := range routes {
+		paths = append(paths, r.path)
+	}
+	return paths
+}
+
+func TestRoutesOrder(t *testing.T) {
+	routes, _ := parseRoutes("", map[string]Handler{
+		"::/users/{all}":           okHandler,
+		"::/users/{id:[0-9]+}":     okHandler,
+		"::/users/new":             okHandler,
+		"::/users":                 okHandler,
+		"::/users/{id}/edit":       okHandler,
+		"::/admin":                 okHandler,
+		"::/{page}":                okHandler,
+		"POST::/users/{id:[0-9]+}": okHandler,
+	})
+	sort.Sort(routesOrder(routes))
+
+	expected := []string{
+		"/admin",
+		"/users/new",
+		"/users/{id:[0-9]+}",
+		"/users/{id:[0-9]+}",
+		"/users/{all}",
+		"/users/{id}/edit",
+		"/users",
+		"/{page}",
+	}
+	if got := routePaths(routes); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("order: got %v, expected %v", got, expected)
+	}
+	if routes[2].key != "::/users/{id:[0-9]+}" {
+		t.Errorf("same paths should be sorted by key, got %s first", routes[2].key)
+	}
+}
+
+// Registers the routes in order as the app does, returning the warnings.
+func conflictsOf(groups ...[]*route) []string {
+	registered := []*route{}
+	warnings := []string{}
+	for _, routes := range groups {
+		for _, r := range routes {
+			warnings = append(warnings, routeConflicts(registered, r)...)
+			registered = append(registered, r)
+		}
+	}
+	return warnings
+}
+
+func TestRouteConflicts(t *testing.T) {
+	top := func(routes map[string]Handler) []*route {
+		entries, _ := parseRoutes("", routes)
+		return entries
+	}
+	admin := func(routes map[string]Handler) []*route {
+		entries, _ := parseRoutes("/_/admin", routes)
+		return entries
+	}
+
+	tests := []struct {
+		name     string
+		groups   [][]*route
+		warnings int
+	}{
+		{
+			"static before variable",
+			[][]*route{top(map[string]Handler{
+				"GET::/users/new":  okHandler,
+				"GET::/users/{id}": okHandler,
+			})},
+			0,
+		},
+		{
+			"different methods",
+			[][]*route{top(map[string]Handler{
+				"GET::/users/{id}":         okHandler,
+				"POST::/users/{id:[0-9]+}": okHandler,
+			})},
+			0,
+		},
+		{
+			"different variable patterns",
+			[][]*route{top(map[string]Handler{
+				"GET::/users/{all}":       okHandler,
+				"GET::/users/{id:[0-9]+}": okHandler,
+			})},
+			1,
+		},
+		{
+			"variable segments in different places",
+			[][]*route{top(map[string]Handler{
+				"GET::/{lang}/users":    okHandler,
+				"GET::/posts/{section}": okHandler,
+			})},
+			1,
+		},
+		{
+			"app route shadowing a group one",
+			[][]*route{
+				top(map[string]Handler{"GET::/_/admin/{page}": okHandler}),
+				admin(map[string]Handler{"GET::/users": okHandler}),
+			},
+			1,
+		},
+		{
+			"app route before a group variable",
+			[][]*route{
+				top(map[string]Handler{"GET::/_/admin/dashboard": okHandler}),
+				admin(map[string]Handler{"GET::/{page}": okHandler}),
+			},
+			0,
+		},
+	}
+	for _, test := range tests {
+		if warnings := conflictsOf(test.groups...); len(warnings) != test.warnings {
+			t.Errorf("%s: got warnings %q, expected %d", test.name, warnings, test.warnings)
+		}
+	}
+}
+
+func TestRouteConflictsPanics(t *testing.T) {
+	tests := []map[string]Handler{
+		{"GET::/users/{id}": okHandler, "GET::/users/{key}": okHandler},
+		{"::/users/{id:[0-9]+}": okHandler, "POST::/users/{n:[0-9]+}": okHandler},
+	}
+	for _, routes := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("routes %v should conflict", routes)
+				}
+			}()
+			entries, _ := parseRoutes("", routes)
+			conflictsOf(entries)
+		}()
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SecurityPolicy describes the security headers of the responses.
+type SecurityPolicy struct {
+	// Content-Security-Policy value. Every {nonce} is replaced by the nonce
+	// of the request, which the templates can read with {{cspNonce}}:
+	//    "default-src 'self'; script-src 'self' {nonce}; frame-ancestors 'none'"
+	CSP string
+
+	// Sends the CSP in the Content-Security-Policy-Report-Only header, so the
+	// violations are only reported (add a report-uri directive to the CSP)
+	ReportOnly bool
+
+	// Strict-Transport-Security max-age, zero disables the header
+	HSTSMaxAge                         time.Duration
+	HSTSIncludeSubdomains, HSTSPreload bool
+
+	// X-Frame-Options value (DENY, SAMEORIGIN), empty to omit it. Modern
+	// browsers prefer the frame-ancestors directive of the CSP.
+	FrameOptions string
+
+	// Referrer-Policy value, empty to omit it
+	ReferrerPolicy string
+
+	// Sends X-Content-Type-Options: nosniff
+	NoSniff bool
+}
+
+// Default policy of the new apps. Change it with App.SetSecurityPolicy.
+var DefaultSecurity = &SecurityPolicy{
+	FrameOptions:   "SAMEORIGIN",
+	ReferrerPolicy: "strict-origin-when-cross-origin",
+	NoSniff:        true,
+}
+
+// Applies the security policy to all the responses of the route, overriding
+// the app default one.
+func Security(p *SecurityPolicy) Middleware {
+	return func(h Handler) Handler {
+		return func(r *Request) error {
+			r.SetSecurityPolicy(p)
+			return h(r)
+		}
+	}
+}
+
+// Overrides the security policy of the app and the route for this response.
+// A nil policy sends no security headers at all.
+func (r *Request) SetSecurityPolicy(p *SecurityPolicy) {
+	r.securityPolicy = p
+}
+
+// Returns the random nonce of the request for the CSP. Use it in the inline
+// scripts & styles: <script nonce="{{cspNonce}}">.
+func (r *Request) CSPNonce() (string, error) {
+	if r.cspNonce == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("generate csp nonce failed: %s", err)
+		}
+		r.cspNonce = base64.StdEncoding.EncodeToString(b)
+	}
+	return r.cspNonce, nil
+}
+
+// Emits the headers of the request security policy. It runs as a before
+// commit hook, so the handlers can change the policy until the end.
+func (r *Request) writeSecurityHeaders() error {
+	p := r.securityPolicy
+	if p == nil {
+		return nil
+	}
+	header := r.W.Header()
+
+	if p.CSP != "" {
+		csp := p.CSP
+		if strings.Contains(csp, "{nonce}") {
+			nonce, err := r.CSPNonce()
+			if err != nil {
+				return err
+			}
+			csp = strings.Replace(csp, "{nonce}", "'nonce-"+nonce+"'", -1)
+		}
+
+		name := "Content-Security-Policy"
+		if p.ReportOnly {
+			name += "-Report-Only"
+		}
+		header.Set(name, csp)
+	}
+
+	if p.HSTSMaxAge > 0 {
+		hsts := fmt.Sprintf("max-age=%d", int(p.HSTSMaxAge.Seconds()))
+		if p.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if p.HSTSPreload {
+			hsts += "; preload"
+		}
+		header.Set("Strict-Transport-Security", hsts)
+	}
+
+	setHeaderIfNotEmpty(header, "X-Frame-Options", p.FrameOptions)
+	setHeaderIfNotEmpty(header, "Referrer-Policy", p.ReferrerPolicy)
+	if p.NoSniff {
+		header.Set("X-Content-Type-Options", "nosniff")
+	}
+	return nil
+}
+
+func setHeaderIfNotEmpty(header http.Header, name, value string) {
+	if value != "" {
+		header.Set(name, value)
+	}
+}
@@ -0,0 +1,271 @@
+package app
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"conf"
+
+	"appengine"
+	"appengine/datastore"
+
+	gaesessions "code.google.com/p/sadbox/appengine/sessions"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Datastore kind of the sessions saved by the default store of the apps
+// created with NewApp. Apps upgrading from an older version must set it to
+// their old model.KindSession before, or the existing sessions are lost.
+var DefaultSessionKind = "Session"
+
+// Returned when changing the session of a request without one: the Sessions
+// middleware must run before.
+var ErrNoSession = errors.New("session not loaded")
+
+// SessionOptions controls the session cookie and its expiration.
+type SessionOptions struct {
+	Path, Domain string
+
+	// Lifetime of the session; zero for sessions that never expire in the
+	// server and last until the browser is closed
+	MaxAge time.Duration
+
+	// Absolute sessions expire MaxAge after their creation no matter their
+	// activity; the rest expire MaxAge after their last request (sliding)
+	Absolute bool
+
+	Secure, HttpOnly bool
+	SameSite         http.SameSite
+}
+
+// Options of the new apps. Change them with App.SetSessionOptions.
+var DefaultSessionOptions = &SessionOptions{
+	Path:     "/",
+	MaxAge:   7 * 24 * time.Hour,
+	HttpOnly: true,
+	SameSite: http.SameSiteLaxMode,
+}
+
+// Expires the session if needed and sets its cookie options, refreshing the
+// sliding expiration.
+func (o *SessionOptions) apply(session *sessions.Session) {
+	now := time.Now().Unix()
+	created, _ := session.Values["created"].(int64)
+	seen, _ := session.Values["seen"].(int64)
+	maxAge := int64(o.MaxAge.Seconds())
+
+	if o.MaxAge > 0 && !session.IsNew {
+		start := seen
+		if o.Absolute {
+			start = created
+		}
+		if now-start > maxAge {
+			resetSession(session)
+		}
+	}
+	if session.IsNew || created == 0 {
+		created = now
+		session.Values["created"] = created
+	}
+	session.Values["seen"] = now
+
+	if o.MaxAge > 0 && o.Absolute {
+		maxAge = created + maxAge - now
+	}
+	session.Options = &sessions.Options{
+		Path:     o.Path,
+		Domain:   o.Domain,
+		MaxAge:   int(maxAge),
+		Secure:   o.Secure,
+		HttpOnly: o.HttpOnly,
+		SameSite: o.SameSite,
+	}
+}
+
+// Empties the session and forces a new ID on the next save.
+func resetSession(session *sessions.Session) {
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	session.ID = ""
+	session.IsNew = true
+}
+
+// Saves the session with a new ID, keeping its values, to prevent session
+// fixation attacks. Call it after the login and any other privilege change.
+// The old ID is deleted from the store if it implements SessionDeleter.
+// It returns ErrNoSession if the session was not loaded.
+func (r *Request) RegenerateSession() error {
+	if r.Session == nil {
+		return ErrNoSession
+	}
+	old := r.Session.ID
+	r.Session.ID = ""
+	r.Session.IsNew = true
+	r.Session.Values["created"] = time.Now().Unix()
+	return r.deleteSession(old)
+}
+
+// Empties the session, deletes it from the store if it implements
+// SessionDeleter and deletes its cookie when the response is sent. The
+// changes made to the session afterwards are lost. It returns ErrNoSession if
+// the session was not loaded.
+func (r *Request) DestroySession() error {
+	if r.Session == nil {
+		return ErrNoSession
+	}
+	old := r.Session.ID
+	r.Session.Options.MaxAge = -1
+	resetSession(r.Session)
+	return r.deleteSession(old)
+}
+
+// SessionDeleter is implemented by the stores that keep the session values in
+// the server, so the old cookies can't be replayed after destroying or
+// regenerating a session. The cookie store can't do it: its values travel in
+// the cookie itself.
+type SessionDeleter interface {
+	Delete(r *http.Request, name, id string) error
+}
+
+func (r *Request) deleteSession(id string) error {
+	deleter, ok := r.app.sessionStore.(SessionDeleter)
+	if id == "" || !ok {
+		return nil
+	}
+	if err := deleter.Delete(r.Req, r.Session.Name(), id); err != nil {
+		return fmt.Errorf("delete session failed: %s", err)
+	}
+	return nil
+}
+
+// Returns the store used by the new apps: the datastore one, signed with
+// conf.SessionSecret. Change it with App.SetSessionStore.
+func defaultSessionStore() sessions.Store {
+	return NewDatastoreStore(DefaultSessionKind, []byte(conf.SessionSecret))
+}
+
+// Saves the sessions in the datastore with the kind, and their ID in a
+// cookie signed (and optionally encrypted) with the key pairs.
+func NewDatastoreStore(kind string, keyPairs ...[]byte) sessions.Store {
+	return &datastoreStore{gaesessions.NewDatastoreStore(kind, keyPairs...), kind}
+}
+
+// Adds the deletion of the sessions to the datastore store.
+type datastoreStore struct {
+	sessions.Store
+	kind string
+}
+
+func (s *datastoreStore) Delete(r *http.Request, name, id string) error {
+	c := appengine.NewContext(r)
+	err := datastore.Delete(c, datastore.NewKey(c, s.kind, id, 0, nil))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return nil
+}
+
+// Saves the sessions in a cookie signed (and optionally encrypted) with the
+// key pairs. The values must fit in the 4KB limit of the cookies.
+func NewCookieStore(keyPairs ...[]byte) sessions.Store {
+	return sessions.NewCookieStore(keyPairs...)
+}
+
+// MemoryStore saves the sessions in the instance memory and their ID in a
+// signed cookie. The sessions are lost on restarts and not shared between
+// instances, so it's only useful for tests and local runs.
+type MemoryStore struct {
+	Options *sessions.Options
+
+	codecs   []securecookie.Codec
+	mutex    sync.Mutex
+	sessions map[string]map[interface{}]interface{}
+}
+
+func NewMemoryStore(keyPairs ...[]byte) *MemoryStore {
+	return &MemoryStore{
+		Options:  &sessions.Options{Path: "/"},
+		codecs:   securecookie.CodecsFromPairs(keyPairs...),
+		sessions: map[string]map[interface{}]interface{}{},
+	}
+}
+
+// Returns the session from the request registry, loading it if needed.
+func (s *MemoryStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// Loads the session of the request cookie or returns a new one.
+func (s *MemoryStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.codecs...); err != nil {
+		return session, fmt.Errorf("decode session cookie failed: %s", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	values, ok := s.sessions[id]
+	if !ok {
+		return session, nil
+	}
+	session.ID = id
+	session.IsNew = false
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	return session, nil
+}
+
+// Deletes the session values saved with the ID.
+func (s *MemoryStore) Delete(r *http.Request, name, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+// Saves the session values in memory and its ID in the response cookie. A
+// negative MaxAge deletes the session.
+func (s *MemoryStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if session.Options.MaxAge < 0 {
+		delete(s.sessions, session.ID)
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = hex.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
+	values := map[interface{}]interface{}{}
+	for k, v := range session.Values {
+		values[k] = v
+	}
+	s.sessions[session.ID] = values
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return fmt.Errorf("encode session cookie failed: %s", err)
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
@@ -0,0 +1,17 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestSessionChangesWithoutSession(t *testing.T) {
+	r, _, done := newTestRequest(t, "GET")
+	defer done()
+
+	if err := r.RegenerateSession(); err != ErrNoSession {
+		t.Errorf("regenerate: got %v, expected ErrNoSession", err)
+	}
+	if err := r.DestroySession(); err != ErrNoSession {
+		t.Errorf("destroy: got %v, expected ErrNoSession", err)
+	}
+}
@@ -13,13 +13,37 @@ import (
 var (
 	templatesMutex = &sync.Mutex{}
 	templatesCache = map[string]*template.Template{}
+	templatesFuncs = template.FuncMap{}
 )
 
+func init() {
+	// Build the URL of a named route: {{url "user" "id" .UserId}}. It's replaced
+	// by the request bound one when executing through Request.Template.
+	AddTemplateFunc("url", func(name string, pairs ...string) (string, error) {
+		return "", fmt.Errorf("url %s: no request bound to the template", name)
+	})
+
+	// Nonce of the request CSP: <script nonce="{{cspNonce}}">. It's replaced
+	// by the request bound one too.
+	AddTemplateFunc("cspNonce", func() (string, error) {
+		return "", fmt.Errorf("cspNonce: no request bound to the template")
+	})
+}
+
+// Registers a function that all the templates can use. It should be called
+// before executing the first template.
+func AddTemplateFunc(name string, f interface{}) {
+	templatesFuncs[name] = f
+}
+
 type TemplateConfig struct {
 	Names                 []string
 	W                     io.Writer
 	Data                  interface{}
 	Dir                   string
+
+	// Functions that override the global ones for this execution only
+	Funcs template.FuncMap
 }
 
 func Template(w io.Writer, names []string, data interface{}) error {
@@ -44,13 +68,19 @@ func ExecTemplate(c *TemplateConfig) error {
 	t, ok := templatesCache[cname]
 	if !ok || appengine.IsDevAppServer() {
 		var err error
-		t, err = template.New(cname).ParseFiles(c.Names...)
+		t, err = template.New(cname).Funcs(templatesFuncs).ParseFiles(c.Names...)
 		if err != nil {
 			return fmt.Errorf("templates parsing failed: %s", err)
 		}
 		templatesCache[cname] = t
 	}
 
+	// Reset the functions bound to a previous execution
+	t.Funcs(templatesFuncs)
+	if c.Funcs != nil {
+		t.Funcs(c.Funcs)
+	}
+
 	if err := t.ExecuteTemplate(c.W, "base", c.Data); err != nil {
 		return fmt.Errorf("exec templates failed: %s", err)
 	}
@@ -0,0 +1,199 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Reasons of the XSRF check failures, see Request.XSRFError.
+var (
+	ErrXSRFNoSession = errors.New("xsrf: no session to read the secret from")
+	ErrXSRFMissing   = errors.New("xsrf: token header missing")
+	ErrXSRFMalformed = errors.New("xsrf: token malformed")
+	ErrXSRFInvalid   = errors.New("xsrf: token signature invalid")
+	ErrXSRFExpired   = errors.New("xsrf: token expired")
+)
+
+// Lifetime of the XSRF tokens. A new token is issued in the XSRF-TOKEN cookie
+// when the current one reaches half of it, but the old ones keep working until
+// they expire, so parallel requests and multiple tabs never get rejected.
+var XSRFTokenMaxAge = 24 * time.Hour
+
+// BearerAuth validates the token of a request with an "Authorization: Bearer"
+// header, returning an error (like Unauthorized()) to reject it. It can save
+// the authenticated identity anywhere in the request, see App.SetBearerAuth.
+type BearerAuth func(r *Request, token string) error
+
+// Issues the XSRF token in the XSRF-TOKEN cookie (the one AngularJS reads)
+// and rejects with a 403 the requests without a valid token in the
+// X-XSRF-TOKEN header, except the ones with a safe method (GET, HEAD &
+// OPTIONS). The tokens are signed with a secret saved in the session.
+//
+// The exempted routes (App.ExemptXSRF, Group.ExemptXSRF), the App Engine task
+// queue & cron requests and the requests with an accepted bearer token don't
+// need the token.
+func XSRF(h Handler) Handler {
+	return func(r *Request) error {
+		now := time.Now()
+		if r.Session != nil {
+			issueXSRFToken(r, now)
+		}
+
+		// The bearer tokens are validated for every method, so the handlers
+		// get the identity even in the safe ones
+		bearer, err := r.checkBearer()
+		if err != nil {
+			return err
+		}
+
+		if !isSafeMethod(r.Req.Method) && !bearer && !r.skipXSRF() {
+			if err := checkXSRFRequest(r, now); err != nil {
+				return r.rejectXSRF(err)
+			}
+		}
+		return h(r)
+	}
+}
+
+// Sets a new token in the cookie if the current one is about to expire.
+func issueXSRFToken(r *Request, now time.Time) {
+	secret := xsrfSecret(r)
+	issued := time.Time{}
+	if cookie, err := r.Req.Cookie("XSRF-TOKEN"); err == nil {
+		issued, _ = checkXSRFToken(secret, cookie.Value, now)
+	}
+	if now.Sub(issued) > XSRFTokenMaxAge/2 {
+		http.SetCookie(r.W, &http.Cookie{
+			Name:  "XSRF-TOKEN",
+			Value: newXSRFToken(secret, now),
+			Path:  "/",
+		})
+	}
+
+	// Credentialed cross-origin clients can't read the cookie
+	if r.corsCreds {
+		r.W.Header().Set("X-Xsrf-Token", newXSRFToken(secret, now))
+	}
+}
+
+// Checks the token of the request header.
+func checkXSRFRequest(r *Request, now time.Time) error {
+	if r.Session == nil {
+		return ErrXSRFNoSession
+	}
+	token := r.Req.Header.Get("X-Xsrf-Token")
+	if token == "" {
+		return ErrXSRFMissing
+	}
+	_, err := checkXSRFToken(xsrfSecret(r), token, now)
+	return err
+}
+
+// Returns true if the request is exempted from the XSRF check.
+func (r *Request) skipXSRF() bool {
+	if r.route != nil && r.route.exemptFromXSRF() {
+		return true
+	}
+	return isAppEngineInternal(r.Req)
+}
+
+// Returns true if the request has an accepted bearer token, or the error of
+// the rejected ones.
+func (r *Request) checkBearer() (bool, error) {
+	auth := r.Req.Header.Get("Authorization")
+	if r.app.bearerAuth == nil || !strings.HasPrefix(auth, "Bearer ") {
+		return false, nil
+	}
+	if err := r.app.bearerAuth(r, strings.TrimPrefix(auth, "Bearer ")); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns true if the request comes from the App Engine task queues or cron.
+// App Engine removes these headers from the external requests; to protect
+// against spoofing anyway (other proxies in front of the app, ...) the
+// internal source address of those services is checked too in production.
+func isAppEngineInternal(req *http.Request) bool {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	dev := appengine.IsDevAppServer()
+
+	if req.Header.Get("X-AppEngine-QueueName") != "" && (dev || ip == "0.1.0.2") {
+		return true
+	}
+	if req.Header.Get("X-AppEngine-Cron") == "true" && (dev || ip == "0.1.0.1") {
+		return true
+	}
+	return false
+}
+
+// Returns the reason of the XSRF check failure of the request, if any. The
+// 403 error handler can use it to explain the rejection.
+func (r *Request) XSRFError() error {
+	return r.xsrfErr
+}
+
+func (r *Request) rejectXSRF(reason error) error {
+	r.C.Errorf("[xsrf] %s", reason)
+	r.xsrfErr = reason
+	return Forbidden(reason)
+}
+
+// Returns the XSRF secret of the session, generating it the first time.
+func xsrfSecret(r *Request) []byte {
+	secret, _ := r.Session.Values["xsrf"].([]byte)
+	if len(secret) == 0 {
+		secret = securecookie.GenerateRandomKey(32)
+		r.Session.Values["xsrf"] = secret
+	}
+	return secret
+}
+
+// Builds a token with the issue time and its HMAC signature.
+func newXSRFToken(secret []byte, issued time.Time) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(issued.Unix()))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	return base64.URLEncoding.EncodeToString(mac.Sum(msg))
+}
+
+// Verifies the token signature in constant time and its age. It returns the
+// time the token was issued.
+func checkXSRFToken(secret []byte, token string, now time.Time) (time.Time, error) {
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return time.Time{}, ErrXSRFMalformed
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(raw[:8])
+	if !hmac.Equal(mac.Sum(nil), raw[8:]) {
+		return time.Time{}, ErrXSRFInvalid
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	if now.Sub(issued) > XSRFTokenMaxAge || issued.After(now.Add(time.Minute)) {
+		return time.Time{}, ErrXSRFExpired
+	}
+	return issued, nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
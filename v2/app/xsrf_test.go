@@ -0,0 +1,83 @@
+package app
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestCheckXSRFToken(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1500000000, 0)
+	token := newXSRFToken(secret, now)
+
+	raw, _ := base64.URLEncoding.DecodeString(token)
+	raw[len(raw)-1] ^= 1
+	tampered := base64.URLEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		name   string
+		secret []byte
+		token  string
+		now    time.Time
+		err    error
+	}{
+		{"valid", secret, token, now, nil},
+		{"valid before expiring", secret, token, now.Add(XSRFTokenMaxAge), nil},
+		{"tampered mac", secret, tampered, now, ErrXSRFInvalid},
+		{"wrong secret", []byte("other"), token, now, ErrXSRFInvalid},
+		{"expired", secret, token, now.Add(XSRFTokenMaxAge + time.Second), ErrXSRFExpired},
+		{"future dated", secret, newXSRFToken(secret, now.Add(time.Hour)), now, ErrXSRFExpired},
+		{"clock skew", secret, newXSRFToken(secret, now.Add(30*time.Second)), now, nil},
+		{"not base64", secret, "not a token!", now, ErrXSRFMalformed},
+		{"truncated", secret, token[:20], now, ErrXSRFMalformed},
+	}
+	for _, test := range tests {
+		issued, err := checkXSRFToken(test.secret, test.token, test.now)
+		if err != test.err {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, test.err)
+		}
+		if err == nil && issued.After(test.now.Add(time.Minute)) {
+			t.Errorf("%s: issued time %s too far ahead", test.name, issued)
+		}
+	}
+}
+
+func TestIssueXSRFToken(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1500000000, 0)
+
+	tests := []struct {
+		name    string
+		cookie  string
+		reissue bool
+	}{
+		{"no cookie", "", true},
+		{"fresh token", newXSRFToken(secret, now.Add(-time.Hour)), false},
+		{"past half life", newXSRFToken(secret, now.Add(-XSRFTokenMaxAge/2-time.Second)), true},
+		{"invalid token", newXSRFToken([]byte("other"), now), true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "XSRF-TOKEN", Value: test.cookie})
+		}
+		rec := httptest.NewRecorder()
+		r := &Request{Req: req, W: rec, Session: sessions.NewSession(nil, "session")}
+		r.Session.Values["xsrf"] = secret
+
+		issueXSRFToken(r, now)
+		cookie := rec.Header().Get("Set-Cookie")
+		if reissued := cookie != ""; reissued != test.reissue {
+			t.Errorf("%s: reissued %v, expected %v", test.name, reissued, test.reissue)
+		}
+		if test.reissue && !strings.HasPrefix(cookie, "XSRF-TOKEN="+newXSRFToken(secret, now)) {
+			t.Errorf("%s: cookie %q, expected a new token", test.name, cookie)
+		}
+	}
+}